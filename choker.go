@@ -0,0 +1,169 @@
+package main
+
+/*
+* decides which interested peers we upload to (tit-for-tat)
+* every round the peers that give us the most get unchoked, plus one optimistic unchoke
+* so new peers get a chance to prove themselves
+ */
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// chokeInterval is the time between two choking rounds
+const chokeInterval = 10 * time.Second
+
+// optimisticRounds is the number of rounds an optimistic unchoke lasts, 30 seconds
+const optimisticRounds = 3
+
+// Choker unchokes the best maxUnchoked peers of a torrent
+type Choker struct {
+	maxUnchoked int         //peers unchoked at once, the optimistic unchoke included
+	seeding     func() bool //whether we have every piece, peers are then ranked by upload rate
+
+	peers      map[*ConnectionManager]bool
+	optimistic *ConnectionManager //the current optimistic unchoke, nil if none
+	round      int
+
+	lock *sync.Mutex
+}
+
+/*
+* create a choker, Run starts the rounds
+* @maxUnchoked: peers unchoked at once, the optimistic unchoke included
+* @seeding: reports whether we have every piece
+* returns: the choker
+ */
+func NewChoker(maxUnchoked int, seeding func() bool) *Choker {
+	if maxUnchoked < 1 {
+		maxUnchoked = 1
+	}
+	return &Choker{
+		maxUnchoked: maxUnchoked,
+		seeding:     seeding,
+		peers:       make(map[*ConnectionManager]bool),
+		lock:        &sync.Mutex{},
+	}
+}
+
+/*
+* runs a choking round every chokeInterval, rotating the optimistic unchoke every optimisticRounds rounds
+* @stop: closed to end the rounds, nil to run forever
+ */
+func (c *Choker) Run(stop <-chan bool) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.lock.Lock()
+			c.rechoke(c.round%optimisticRounds == 0)
+			c.round++
+			c.lock.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+/*
+* starts choking decisions for a connection, peers start out choked
+* @peer: the connection
+ */
+func (c *Choker) Add(peer *ConnectionManager) {
+	c.lock.Lock()
+	c.peers[peer] = true
+	c.lock.Unlock()
+}
+
+/*
+* forgets a closed connection
+* @peer: the connection
+ */
+func (c *Choker) Remove(peer *ConnectionManager) {
+	c.lock.Lock()
+	delete(c.peers, peer)
+	if c.optimistic == peer {
+		c.optimistic = nil
+	}
+	c.lock.Unlock()
+}
+
+/*
+* called when a peer becomes interested, it is unchoked right away if there is a free slot
+* otherwise it waits for the next round
+* @peer: the connection
+ */
+func (c *Choker) PeerInterested(peer *ConnectionManager) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	unchoked := 0
+	for p := range c.peers {
+		if !p.IsChoking() {
+			unchoked++
+		}
+	}
+	if unchoked < c.maxUnchoked {
+		peer.SetChoking(false)
+	}
+}
+
+/*
+* HELPER
+* unchokes the interested peers with the best rates and the optimistic unchoke, chokes everyone else
+* lock must be held
+* @rotate: pick a new optimistic unchoke
+ */
+func (c *Choker) rechoke(rotate bool) {
+	seeding := c.seeding()
+	var interested []*ConnectionManager
+	rates := make(map[*ConnectionManager]float64)
+	for p := range c.peers {
+		if !p.IsPeerInterested() {
+			continue
+		}
+		interested = append(interested, p)
+		if seeding {
+			rates[p] = p.UploadRate()
+		} else {
+			rates[p] = p.DownloadRate()
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	//one slot is kept for the optimistic unchoke
+	regular := c.maxUnchoked - 1
+	if regular < 1 {
+		regular = c.maxUnchoked
+	}
+	if regular > len(interested) {
+		regular = len(interested)
+	}
+	unchoke := make(map[*ConnectionManager]bool)
+	for _, p := range interested[:regular] {
+		unchoke[p] = true
+	}
+
+	if c.optimistic != nil && (!c.peers[c.optimistic] || !c.optimistic.IsPeerInterested()) {
+		c.optimistic = nil
+	}
+	if rotate || c.optimistic == nil || unchoke[c.optimistic] {
+		choices := interested[regular:]
+		c.optimistic = nil
+		if len(choices) > 0 {
+			c.optimistic = choices[rand.Intn(len(choices))]
+		}
+	}
+	if c.optimistic != nil && len(unchoke) < c.maxUnchoked {
+		unchoke[c.optimistic] = true
+	}
+
+	for p := range c.peers {
+		p.SetChoking(!unchoke[p])
+	}
+}
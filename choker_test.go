@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+* HELPER
+* a connection the choker can rank, its rates hold still for the test
+* @interested: whether the peer wants to download from us
+* @download: bytes per second we get from the peer
+* @upload: bytes per second we send to the peer
+* returns: the connection, added to the choker
+ */
+func chokerPeer(t *testing.T, c *Choker, interested bool, download float64, upload float64) *ConnectionManager {
+	cm := NewConnectionManager(nil, 10, 10, c, nil)
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	cm.conn = local
+	cm.status.PeerInterested = interested
+	// a meter updated less than a second ago keeps its rate
+	cm.downloadRate.rate, cm.downloadRate.last = download, time.Now().Add(time.Hour)
+	cm.uploadRate.rate, cm.uploadRate.last = upload, time.Now().Add(time.Hour)
+	c.Add(&cm)
+	return &cm
+}
+
+/*
+* HELPER
+* returns: the indexes of the unchoked peers
+ */
+func unchokedPeers(peers []*ConnectionManager) map[int]bool {
+	unchoked := make(map[int]bool)
+	for i, p := range peers {
+		if !p.IsChoking() {
+			unchoked[i] = true
+		}
+	}
+	return unchoked
+}
+
+func TestChokerUnchokesTopPeers(t *testing.T) {
+	tests := []struct {
+		name        string
+		seeding     bool
+		wantRegular []int // the peers with the best rates, always unchoked
+	}{
+		{name: "leeching ranks by download rate", seeding: false, wantRegular: []int{3, 4}},
+		{name: "seeding ranks by upload rate", seeding: true, wantRegular: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChoker(3, func() bool { return tt.seeding })
+			var peers []*ConnectionManager
+			for i := 0; i < 5; i++ {
+				peers = append(peers, chokerPeer(t, c, true, float64(i*100), float64((4-i)*100)))
+			}
+			// the fastest peer of all does not want anything from us
+			uninterested := chokerPeer(t, c, false, 1000, 1000)
+
+			c.rechoke(true)
+			unchoked := unchokedPeers(peers)
+			if len(unchoked) != 3 || !uninterested.IsChoking() {
+				t.Fatalf("unchoked %v, uninterested unchoked: %v, want 3 interested peers", unchoked, !uninterested.IsChoking())
+			}
+			for _, i := range tt.wantRegular {
+				if !unchoked[i] {
+					t.Fatalf("unchoked %v, want %v among them", unchoked, tt.wantRegular)
+				}
+			}
+			if c.optimistic == nil || c.optimistic.IsChoking() || c.optimistic == peers[tt.wantRegular[0]] || c.optimistic == peers[tt.wantRegular[1]] {
+				t.Fatal("optimistic unchoke took a regular slot")
+			}
+		})
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	c := NewChoker(2, func() bool { return false })
+	fastest := chokerPeer(t, c, true, 1000, 0)
+	for i := 0; i < 4; i++ {
+		chokerPeer(t, c, true, 0, 0)
+	}
+
+	c.rechoke(true)
+	first := c.optimistic
+	if first == nil || first == fastest || first.IsChoking() {
+		t.Fatal("no optimistic unchoke next to the regular one")
+	}
+	// rounds in between keep it
+	for round := 0; round < optimisticRounds-1; round++ {
+		c.rechoke(false)
+		if c.optimistic != first || first.IsChoking() {
+			t.Fatal("optimistic unchoke changed before its rounds were up")
+		}
+	}
+	// rotating draws from every peer outside the regular slots, another one gets its turn soon
+	for round := 0; c.optimistic == first; round++ {
+		if round == 100 {
+			t.Fatal("optimistic unchoke never rotated")
+		}
+		c.rechoke(true)
+	}
+	if !first.IsChoking() || c.optimistic.IsChoking() || fastest.IsChoking() {
+		t.Fatal("rotation did not move the optimistic slot")
+	}
+
+	// a peer that lost interest gives the slot up without waiting for the rotation
+	second := c.optimistic
+	second.status.PeerInterested = false
+	c.rechoke(false)
+	if c.optimistic == second || c.optimistic == nil || !second.IsChoking() {
+		t.Fatal("uninterested peer kept the optimistic unchoke")
+	}
+}
@@ -1,151 +1,279 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
-	//	"strings"
+	"strings"
 	"sync"
-	"time"
+	"syscall"
 )
 
-//ClientID is the 20 byte id of our client
 //ProtoName is the BitTorrent protocol we are using
+//ClientVersion is sent to peers in the extended handshake
 const (
-	ListenPort = 6881
-	ProtoName  = "BitTorrent protocol"
-	ClientID   = "DONDESTALABIBLIOTECA"
+	ListenPort    = 6881
+	ProtoName     = "BitTorrent protocol"
+	ClientVersion = "Bittorrent 0.1"
 )
 
-var manager PeerContactManager
-var killCh chan bool = make(chan bool) // used to signal kill tracker connection
+//ClientID is the 20 byte id of our client, generated once per session
+var ClientID = NewPeerID()
 
-func sigHandler(ch chan os.Signal, tkInfo TrackerInfo) {
+func sigHandler(ch chan os.Signal, session *Session) {
 	<-ch
 	fmt.Println("Exiting...")
-	if err := manager.StopDownload(); err != nil {
-		fmt.Println(err)
-	}
-	killCh <- true // stop tracker connection
-	<-killCh       // wait to stop tracker connection
+	session.Close()
 	os.Exit(0)
 
 }
 
-func trackerUpdater(killCh chan bool, tkInfo TrackerInfo, interval int64, iDict InfoDict) {
-	// keep announcing to tracker at Interval seconds
-	ticker := time.NewTicker(time.Second * time.Duration(interval))
-	sentCompleted := false
-	go func() {
-		fmt.Println("updating...")
-		for _ = range ticker.C {
-			tkInfo.Uploaded, tkInfo.Downloaded, tkInfo.Left =
-				manager.GetProgress()
-			tkInfo.sendGetRequest("")
-			if sentCompleted { // finished download
-				return
-			}
+/*
+* caps every torrent at the limits the file gives it, torrents it does not list are not limited
+* @limits: limits by output file, see LoadTorrentLimits
+* @torrents: the running torrents by output file
+ */
+func applyLimits(limits map[string]TorrentLimits, torrents map[string]*SessionTorrent) {
+	for fileName := range limits {
+		if _, ok := torrents[fileName]; !ok {
+			fmt.Println("Limits for", fileName, "match no torrent")
 		}
-	}()
-
-	for {
-		toKill := <-killCh
-		//	fmt.Println("Tokill: ", toKill, " sentCompleted : ", sentCompleted)
-
-		if sentCompleted == false { // just send completed
-			ticker.Stop() // ticker is done
-			// Send event stopped message to tracker
-			tkInfo.Uploaded, tkInfo.Downloaded, tkInfo.Left = manager.GetProgress()
-			// we calculated tkInfo.Downloaded without accounting for the actual length of
-			// the last piece. So, if the total downloaded is some bytes < piece length
-			// just say it downloaded the whole thing.
-			if tkInfo.Downloaded-iDict.Length < iDict.PieceLength {
-				tkInfo.Downloaded = iDict.Length
-				tkInfo.Left = 0
-			}
+	}
+	for fileName, t := range torrents {
+		limit := limits[fileName]
+		t.SetRateLimits(limit.Upload, limit.Download)
+	}
+}
 
-			if tkInfo.Left == 0 { // send completed message if the download is complete
-				//	tkInfo.sendGetRequest("completed")
-			}
-			sentCompleted = true
+/*
+* rereads the limits file on every SIGHUP, a file that does not load leaves the limits as they were
+* @ch: receives the signals
+* @path: the limits file
+* @torrents: the running torrents by output file
+ */
+func limitsReloader(ch chan os.Signal, path string, torrents map[string]*SessionTorrent) {
+	for range ch {
+		limits, err := LoadTorrentLimits(path)
+		if err != nil {
+			fmt.Println("Unable to reload the limits:", err)
+			continue
 		}
+		fmt.Println("Limits reloaded from", path)
+		applyLimits(limits, torrents)
+	}
+}
 
-		if toKill == true { // we are done - return
-			tkInfo.Disconnect()
-			killCh <- true // finished disconnect
-			return
+// torrentFromMagnet gets the info dictionary for a magnet link from the peers its trackers, or the DHT, return
+func torrentFromMagnet(uri string, policy *PeerPolicy, port int, dht *DHT, encryption EncryptionMode) (*Torrent, error) {
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(magnet.Trackers) == 0 && dht == nil {
+		return nil, errors.New("magnet link has no trackers and the DHT is off")
+	}
+
+	var candidates []Peer
+	if len(magnet.Trackers) > 0 {
+		tkInfo := NewTracker(magnet.InfoHash, magnet.Torrent(), &InfoDict{}, ClientID, port)
+		// the length is unknown until the info dictionary arrives, left=0 would tell the tracker we are a seed
+		tkInfo.Left = 1
+		var announceErr error
+		if candidates, _, announceErr = tkInfo.Connect(); announceErr != nil && dht == nil {
+			return nil, announceErr
+		}
+		if announceErr == nil {
+			// the torrent announces itself once it starts, take this announce back so we are not listed twice
+			defer func() {
+				if err := tkInfo.Disconnect(); err != nil {
+					fmt.Println(err)
+				}
+			}()
+		}
+	}
+	if dht != nil {
+		candidates = append(candidates, dht.GetPeers(string(magnet.InfoHash), 0)...)
+	}
+	var peerList []Peer
+	for _, p := range candidates {
+		if policy.Admit(p) {
+			peerList = append(peerList, p)
 		}
 	}
+	fmt.Printf("Fetching metadata for %s from %d peers\n", magnet.DisplayName, len(peerList))
+	return FetchMetadata(magnet, peerList, 30, encryption)
 }
 
 func main() {
-	runtime.GOMAXPROCS(2)
-	if len(os.Args) < 3 {
-		fmt.Println("Illegal USAGE!\n USAGE : ./Bittorrent <torrent_file> <output file>")
+	runtime.GOMAXPROCS(runtime.NumCPU()) // pieces are hash checked on every core
+	policyFile := flag.String("policy", "", "file of allow/deny rules for peers")
+	port := flag.Int("port", ListenPort, "port peers connect to, shared by every torrent")
+	useDHT := flag.Bool("dht", true, "find peers through the mainline DHT as well as the trackers")
+	dhtPort := flag.Int("dhtport", ListenPort, "UDP port of our DHT node")
+	useLSD := flag.Bool("lsd", true, "find peers on the local network with multicast announces")
+	maxRequests := flag.Int("requests", 250, "most block requests in flight to a single peer")
+	maxUnchoked := flag.Int("unchoked", 5, "peers we upload to at once per torrent, the optimistic unchoke included")
+	selection := flag.String("selection", "rarest", "piece selection strategy, rarest or linear")
+	encryption := flag.String("encryption", "enabled", "message stream encryption: disabled, enabled (plaintext peers still served) or forced")
+	ratio := flag.Float64("ratio", 0, "stop seeding once we uploaded this many times the torrent's size, 0 for no limit")
+	seedTime := flag.Duration("seedtime", 0, "stop seeding after this long, e.g. 2h, 0 for no limit")
+	upLimit := flag.Int("up", 0, "upload limit of all torrents together in KiB/s, 0 for no limit")
+	downLimit := flag.Int("down", 0, "download limit of all torrents together in KiB/s, 0 for no limit")
+	peerUpLimit := flag.Int("peerup", 0, "upload limit of a single connection in KiB/s, 0 for no limit")
+	peerDownLimit := flag.Int("peerdown", 0, "download limit of a single connection in KiB/s, 0 for no limit")
+	limitsFile := flag.String("limits", "", "file of per torrent limits, reread on SIGHUP")
+	flag.Parse()
+	// seed mode serves data that is already on disk, verify mode hash checks a download and exits
+	args := flag.Args()
+	seedMode := flag.Arg(0) == "seed"
+	verifyMode := flag.Arg(0) == "verify"
+	if seedMode || verifyMode {
+		args = args[1:]
+	}
+	// every torrent comes with its output file, or data path
+	if len(args) < 2 || len(args)%2 != 0 {
+		fmt.Println("Illegal USAGE!\n USAGE : ./Bittorrent [options] <torrent_file|magnet_uri> <output file> [<torrent_file|magnet_uri> <output file> ...]\n         ./Bittorrent [options] seed <torrent_file> <data path> [<torrent_file> <data path> ...]\n         ./Bittorrent verify <torrent_file> <output file> [<torrent_file> <output file> ...]\n OPTIONS : [-policy <policy file>] [-port <port>] [-dht=false] [-dhtport <port>] [-lsd=false] [-requests <n>] [-unchoked <n>] [-selection rarest|linear] [-encryption disabled|enabled|forced] [-ratio <r>] [-seedtime <duration>] [-up <KiB/s>] [-down <KiB/s>] [-peerup <KiB/s>] [-peerdown <KiB/s>] [-limits <limits file>]")
 		return
 	}
-	torrentFile := os.Args[1]
-	fileName := os.Args[2]
 
-	torrent, err := NewTorrent(torrentFile)
-	if err != nil {
-		log.Fatal("Unable to decode the torrent file\n", err)
+	var policy *PeerPolicy
+	if *policyFile != "" {
+		var err error
+		if policy, err = LoadPeerPolicy(*policyFile); err != nil {
+			log.Fatal("Unable to load the peer policy\n", err)
+		}
 	}
 
-	// create a new tracker and receive the list of peers
-	hash := torrent.InfoHash()
-	iDict := torrent.InfoDict()
+	var limits map[string]TorrentLimits
+	if *limitsFile != "" && !verifyMode {
+		var err error
+		if limits, err = LoadTorrentLimits(*limitsFile); err != nil {
+			log.Fatal("Unable to load the torrent limits\n", err)
+		}
+	}
 
-	// Tracker connection
-	tkInfo := NewTracker(hash, torrent, &iDict, ListenPort)
-	peerList, interval := tkInfo.Connect()
-	fmt.Println(iDict.Length, iDict.PieceLength)
-	/*interval := 2
-	peerList := make([]Peer, 1, 1)
-	peerList[0].IP = "127.0.0.1"
-	peerList[0].PeerID = "DONDESTALABIBLIOTECA"
-	peerList[0].Port = 6881*/
-	//fmt.Printf("%v\n", peerList)
-
-	//Start peer download
-	tInfo := TorrentInfo{
-		TInfo:        &iDict,
-		ClientID:     ClientID,
-		ProtoName:    ProtoName,
-		ProtoNameLen: len(ProtoName),
-		InfoHash:     string(hash[:len(hash)]),
+	pieceSelection := RarestFirst
+	switch *selection {
+	case "rarest":
+	case "linear":
+		pieceSelection = Linear
+	default:
+		log.Fatal("Unknown piece selection strategy ", *selection)
 	}
-	var wg sync.WaitGroup
-	manager = NewPeerContactManager(&tkInfo, &wg, tInfo, fileName, 10, 10, 10)
 
-	// keep announcing to tracker at Interval seconds
-	go trackerUpdater(killCh, tkInfo, interval, iDict)
+	encryptionMode := EncryptionEnabled
+	switch *encryption {
+	case "enabled":
+	case "disabled":
+		encryptionMode = EncryptionDisabled
+	case "forced":
+		encryptionMode = EncryptionForced
+	default:
+		log.Fatal("Unknown encryption mode ", *encryption)
+	}
+
+	session := NewSession(*port, policy, uint32(*maxUnchoked), *maxRequests, pieceSelection)
+	session.SetEncryption(encryptionMode)
+	session.SetRateLimits(*upLimit*1024, *downLimit*1024)
+	session.SetPeerRateLimits(*peerUpLimit*1024, *peerDownLimit*1024)
+	// saves the DHT's nodes for the next run and leaves the LSD group once every torrent stopped
+	defer session.Close()
+	if *useDHT && !verifyMode {
+		if err := session.StartDHT(*dhtPort, ".dht.cache"); err != nil {
+			fmt.Println("Unable to start the DHT, using trackers only:", err)
+		}
+	}
+	if *useLSD && !verifyMode {
+		if err := session.StartLSD(); err != nil {
+			fmt.Println("Unable to start local service discovery:", err)
+		}
+	}
+	var torrents []*SessionTorrent
+	byFile := make(map[string]*SessionTorrent)
+	for i := 0; i < len(args); i += 2 {
+		torrentFile, fileName := args[i], args[i+1]
+
+		var torrent *Torrent
+		var err error
+		if strings.HasPrefix(torrentFile, "magnet:") && !seedMode && !verifyMode {
+			if torrent, err = torrentFromMagnet(torrentFile, policy, *port, session.DHT(), encryptionMode); err != nil {
+				log.Fatal("Unable to get the info dictionary for the magnet link\n", err)
+			}
+		} else if torrent, err = NewTorrent(torrentFile); err != nil {
+			log.Fatal("Unable to decode the torrent file\n", err)
+		}
+
+		if verifyMode {
+			verify(torrent, fileName)
+			continue
+		}
+		t, err := session.AddTorrent(torrent, fileName, seedMode)
+		if err != nil {
+			log.Fatal("Unable to start ", torrentFile, "\n", err)
+		}
+		torrents = append(torrents, t)
+		byFile[fileName] = t
+	}
+	if verifyMode {
+		return
+	}
+	if *limitsFile != "" {
+		applyLimits(limits, byFile)
+		hupChannel := make(chan os.Signal, 1)
+		signal.Notify(hupChannel, syscall.SIGHUP)
+		go limitsReloader(hupChannel, *limitsFile, byFile)
+	}
 
 	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, os.Interrupt)
 	go func() {
-		sigHandler(sigChannel, tkInfo)
+		sigHandler(sigChannel, session)
 	}()
 
 	// start listening for requests
 	go func() {
-		if err := manager.StartIncoming(ListenPort); err != nil {
-			fmt.Println("Listen Error\n")
-			fmt.Println(err)
+		if err := session.Listen(); err != nil {
+			fmt.Println("Listen Error:", err)
 			return
 		}
 	}()
 
-	if err := manager.StartOutgoing(peerList); err != nil {
-		fmt.Println(err)
-		return
+	// keep serving peers, and announcing, until each torrent reaches a seeding limit
+	var wg sync.WaitGroup
+	for _, t := range torrents {
+		wg.Add(1)
+		go func(t *SessionTorrent) {
+			t.Seed(*ratio, *seedTime)
+			t.Stop()
+			wg.Done()
+		}(t)
 	}
+	wg.Wait()
+}
 
-	killCh <- false // don't kill tracker connection but say we completed it
-	fmt.Println("Download completed. Waiting for user input...")
-	for {
-
+// verify hash checks every piece of a download and saves the result to its resume data
+// the data files are only read, missing ones are reported instead of created
+func verify(torrent *Torrent, fileName string) {
+	hash := torrent.InfoHash()
+	iDict := torrent.InfoDict()
+	pieceManager, err := NewVerifyPieceManager(&iDict, string(hash[:]), 10, fileName)
+	if err != nil {
+		fmt.Printf("%s: unable to verify: %v\n", fileName, err)
+		return
+	}
+	defer pieceManager.fileWriter.Finish()
+	have := 0
+	for index := 0; index < iDict.NumPieces(); index++ {
+		if pieceManager.havePiece(index) {
+			have++
+		}
+	}
+	fmt.Printf("%s: %d of %d pieces verified\n", fileName, have, iDict.NumPieces())
+	if err := pieceManager.SaveProgress(); err != nil {
+		log.Fatal("Unable to save progress\n", err)
 	}
 }
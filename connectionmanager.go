@@ -27,6 +27,15 @@ type ConnectionStatus struct {
 	ClientInterested bool //are we interested in the  peer  ?
 }
 
+// minRequestWindow is the fewest block requests kept in flight, however slow the peer
+const minRequestWindow = 2
+
+// sendIdleWait is how long SendNextMessage waits for a message to be queued before returning
+const sendIdleWait = 100 * time.Millisecond
+
+// requestQueueTime is how many seconds of downloading at the peer's current rate the request window covers
+const requestQueueTime = 3
+
 type ConnectionManager struct {
 	status        ConnectionStatus
 	pieceManager  *PieceManager //the global piece manager
@@ -38,15 +47,18 @@ type ConnectionManager struct {
 	tInfo         TorrentInfo
 
 	queueLock *sync.Mutex
+	queued    chan bool //signalled when a message is queued
 
-	toPeerContact   chan<- bool //notifies peer contact manager if we unchoke a peer
-	fromPeerContact <-chan bool //gives us peermission to unchoke a peer
+	choker    *Choker     //decides whether we unchoke the peer, nil leaves it choked
+	chokeLock *sync.Mutex //lock for ClientChoked and PeerInterested, the choker reads them
 
 	timeout int
 	conn    net.Conn
 
-	lastPieceRequest int
-	mutex            *sync.Mutex
+	maxRequests  int         //most block requests kept in flight
+	downloadRate *RateMeter  //payload bytes per second received from the peer
+	uploadRate   *RateMeter  //payload bytes per second sent to the peer
+	mutex        *sync.Mutex //lock for the requests in flight
 
 	flushChan chan bool
 
@@ -54,15 +66,24 @@ type ConnectionManager struct {
 	die      chan bool
 
 	wg *sync.WaitGroup
+
+	policy *PeerPolicy //which peers we talk to, nil admits everyone
+
+	handshake     Handshake         //the handshake the peer sent us
+	peerHandshake ExtendedHandshake //the peer's extended handshake, if it sent one
+	extLock       *sync.Mutex       //lock for peerHandshake
 }
 
 /*
 * create a new peer connection struct
 * @pieceManager: ptr toglobal piece manager for keeping track of pieces uploaded/downloaded
 * @msgQueueMax: the max size of the queue
+* @maxRequests: most block requests kept in flight, the window grows up to it with the peer's download rate
+* @choker: the torrent's choker, decides when the peer gets unchoked
+* @policy: peer admission rules checked against the peer id in the handshake
 * returns: the new connection struct
  */
-func NewConnectionManager(pieceManager *PieceManager, msgQueueMax int, out chan<- bool, in <-chan bool) ConnectionManager {
+func NewConnectionManager(pieceManager *PieceManager, msgQueueMax int, maxRequests int, choker *Choker, policy *PeerPolicy) ConnectionManager {
 	var p ConnectionManager
 
 	p.pieceManager = pieceManager
@@ -78,17 +99,25 @@ func NewConnectionManager(pieceManager *PieceManager, msgQueueMax int, out chan<
 	p.status.PeerInterested = false
 	p.status.ClientInterested = false
 
-	p.toPeerContact = out
-	p.fromPeerContact = in
+	p.choker = choker
+	p.chokeLock = &sync.Mutex{}
+	p.policy = policy
 
 	p.queueLock = &sync.Mutex{}
-	p.mutex = &sync.Mutex{} // lock for lastrequest piece
+	p.queued = make(chan bool, 1)
+	p.mutex = &sync.Mutex{} // lock for requests in flight
+	p.extLock = &sync.Mutex{}
 
 	var pkt Packet
 
 	p.packetHandler = &pkt
 
-	p.lastPieceRequest = -1
+	p.maxRequests = maxRequests
+	if p.maxRequests < minRequestWindow {
+		p.maxRequests = minRequestWindow
+	}
+	p.downloadRate = NewRateMeter()
+	p.uploadRate = NewRateMeter()
 	var wg sync.WaitGroup
 	p.wg = &wg
 	return p
@@ -96,7 +125,8 @@ func NewConnectionManager(pieceManager *PieceManager, msgQueueMax int, out chan<
 
 func (t *ConnectionManager) StopConnection() {
 	t.mutex.Lock()
-	t.pieceManager.UnregisterConnection(t.descriptor, t.lastPieceRequest)
+	t.pieceManager.UnregisterConnection(t.descriptor)
+	t.pieceManager.RemovePeerField(t.descriptor)
 
 	t.pWriter.Flush()
 
@@ -113,7 +143,43 @@ func (t *ConnectionManager) StopConnection() {
 * returns: error
  */
 func (t *ConnectionManager) StartConnection(conn net.Conn, peer Peer, tInfo TorrentInfo, timeout int, interval int) error {
+	t.open(conn, tInfo, timeout, interval)
+
+	if err := t.packetHandler.SendHandshakePacket(t.pWriter, tInfo); err != nil {
+		return err
+	}
 
+	hs, err := t.packetHandler.ReceiveHandshakePacket(t.pReader, peer, tInfo)
+	if err != nil {
+		return err
+	}
+	return t.establish(hs)
+}
+
+/*
+* answers the handshake of an incoming peer, read by the session to find the torrent
+* @conn: the tcp connection for this peer
+* @hs: the handshake the peer sent
+* @tInfo: torent file information struct
+* returns: error
+ */
+func (t *ConnectionManager) AcceptConnection(conn net.Conn, hs Handshake, tInfo TorrentInfo, timeout int, interval int) error {
+	t.open(conn, tInfo, timeout, interval)
+	if hs.InfoHash != tInfo.InfoHash {
+		return errors.New("AcceptConnection: infoHash doesn't match")
+	}
+
+	if err := t.packetHandler.SendHandshakePacket(t.pWriter, tInfo); err != nil {
+		return err
+	}
+	return t.establish(hs)
+}
+
+/*
+* HELPER
+* sets up the reader, writer and flush ticker of the connection
+ */
+func (t *ConnectionManager) open(conn net.Conn, tInfo TorrentInfo, timeout int, interval int) {
 	ticker := time.NewTicker(time.Second * time.Duration(interval))
 	t.flushChan = make(chan bool)
 	go func(flushChan chan bool) {
@@ -128,19 +194,45 @@ func (t *ConnectionManager) StartConnection(conn net.Conn, peer Peer, tInfo Torr
 	t.tInfo = tInfo
 	t.timeout = timeout
 	t.conn = conn
+}
 
-	if err := t.packetHandler.SendHandshakePacket(t.pWriter, tInfo); err != nil {
-		return err
+/*
+* HELPER
+* finishes the start of a connection once handshakes were exchanged: bitfields, extended handshake, keep alives
+* @hs: the handshake the peer sent
+* returns: error
+ */
+func (t *ConnectionManager) establish(hs Handshake) error {
+	tInfo := t.tInfo
+	t.handshake = hs
+	if hs.PeerID == tInfo.ClientID {
+		return errSelfConnection
 	}
-
-	if err := t.packetHandler.ReceiveHandshakePacket(t.pReader, peer, tInfo); err != nil {
-		return err
+	if !t.policy.AdmitPeerID(hs.PeerID) {
+		return errors.New("StartConnection: peer rejected by peer policy")
 	}
 
 	if err := t.sendBitFieldMessage(); err != nil {
 		return err
 	}
 
+	if hs.SupportsExtensions() && tInfo.Extensions != nil {
+		if err := t.sendExtendedHandshake(); err != nil {
+			return err
+		}
+	}
+
+	//tell DHT nodes where to find ours
+	if hs.SupportsDHT() && tInfo.DHT != nil {
+		msg, err := CreateMessage(PORT, Payload{port: uint16(tInfo.DHT.Port())})
+		if err != nil {
+			return err
+		}
+		if err := t.packetHandler.SendArbitraryPacket(t.pWriter, msg); err != nil {
+			return err
+		}
+	}
+
 	if err := t.receiveBitFieldMessage(); err != nil {
 		return err
 	}
@@ -148,8 +240,8 @@ func (t *ConnectionManager) StartConnection(conn net.Conn, peer Peer, tInfo Torr
 	t.received = make(chan bool, 1)
 	t.die = make(chan bool, 1)
 
+	t.wg.Add(1)
 	go func(received chan bool, die chan bool) {
-		t.wg.Add(1)
 		for {
 			//fmt.Println("SLEEPING")
 			time.Sleep(2 * time.Minute)
@@ -198,6 +290,13 @@ func (t *ConnectionManager) sendBitFieldMessage() error {
 func (t *ConnectionManager) receiveBitFieldMessage() error {
 	//register out connection with the piecemanager by giving it our peer's bitfield
 	inMessage, err := t.packetHandler.ReceiveArbitraryPacket(t.pReader, t.timeout, t.conn)
+	//the extended handshake may arrive before the bitfield
+	for err == nil && inMessage.Mtype == EXTENDED {
+		if err = t.handleExtendedMessage(inMessage.Payload); err != nil {
+			return err
+		}
+		inMessage, err = t.packetHandler.ReceiveArbitraryPacket(t.pReader, t.timeout, t.conn)
+	}
 
 	if err != nil {
 
@@ -264,7 +363,10 @@ func (t *ConnectionManager) ReceiveNextMessage() error {
 		//clock how much time has gone by, then push a keepalive in
 	case CHOKE:
 		fmt.Println("CHOKE")
-		t.pieceManager.UnregisterConnection(t.descriptor, t.lastPieceRequest)
+		//the peer drops our requests when it chokes us, give the pieces back
+		t.mutex.Lock()
+		t.pieceManager.UnregisterConnection(t.descriptor)
+		t.mutex.Unlock()
 		//the peer has choked us
 		t.status.PeerChoked = true
 	case UNCHOKE:
@@ -275,66 +377,59 @@ func (t *ConnectionManager) ReceiveNextMessage() error {
 	case INTERESTED:
 
 		//peer is interested in downloading from us
+		t.chokeLock.Lock()
 		t.status.PeerInterested = true
-		//request permission to unchoke this peer
+		t.chokeLock.Unlock()
 		fmt.Println("INTERESTED")
-
-		//t.toPeerContact <- true
-		/*if answer := <-t.fromPeerContact; answer == true {
-			t.status.ClientChoked = false
-			//permission granted, unchoke them
-			fmt.Println("SENDING UNCHOKE")
-			if err := t.QueueMessage(UNCHOKE, Payload{}); err != nil {
-				return err
-			}
-		} else {
-			fmt.Println("NO UNCHOKE")
-			t.status.ClientChoked = true
-			//maybe send a choke msg, or unchoke at a later time?
-		}*/
-		t.status.ClientChoked = false
-		fmt.Printf("Sending UNCHOKE to %v\n", t.conn.RemoteAddr())
-		if err := t.QueueMessage(UNCHOKE, Payload{}); err != nil {
-			return err
+		//the choker unchokes it now if there is a free slot, otherwise in a later round
+		if t.choker != nil {
+			t.choker.PeerInterested(t)
 		}
 
-	//	fmt.Println("ESCAPED")
 	case NOTINTERESTED:
 		fmt.Println("NOT INTERESTED")
 		//peer is not interested in downloading from us
+		t.chokeLock.Lock()
 		t.status.PeerInterested = false
+		t.chokeLock.Unlock()
 	case BITFIELD:
 		fmt.Println("BITFIELD")
 		//this would be an error
 	case PIECE:
-		fmt.Printf("CONNECTION %d: PIECE %d\n", t.descriptor, inMessage.Payload.pieceIndex)
-		//received a piece from peer
-		t.pieceManager.ReceivePiece(t.descriptor, inMessage.Payload.pieceIndex, inMessage.Payload.block)
+		fmt.Printf("CONNECTION %d: PIECE %d BLOCK %d\n", t.descriptor, inMessage.Payload.pieceIndex, inMessage.Payload.begin)
+		//received a block from peer
+		t.downloadRate.Add(len(inMessage.Payload.block))
 		t.mutex.Lock()
-		t.lastPieceRequest = -1
+		completed, err := t.pieceManager.ReceiveBlock(t.descriptor, inMessage.Payload.pieceIndex, inMessage.Payload.begin, inMessage.Payload.block)
 		t.mutex.Unlock()
-		//return HAVE MESSAGE to all peers
-		t.pieceManager.CreateHaveBroadcast(t.descriptor, inMessage.Payload.pieceIndex)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if completed {
+			//return HAVE MESSAGE to all peers
+			t.pieceManager.CreateHaveBroadcast(t.descriptor, inMessage.Payload.pieceIndex)
+		}
 
 	case REQUEST:
 		//a peer has requested a piece
 		fmt.Println("REQUEST", inMessage.Payload)
 
-		if t.status.ClientChoked == true {
-
-			return errors.New("Peer is choked. Cannot cater requests from it")
+		if t.IsChoking() {
+			//the request may have crossed our CHOKE, the peer asks again once unchoked
+			fmt.Println("Ignoring request from choked peer")
+			return nil
 		}
 		fmt.Printf("%v\n", inMessage.Payload.pieceIndex)
 		if err, data := t.pieceManager.GetPiece(inMessage.Payload.pieceIndex, inMessage.Payload.length, inMessage.Payload.begin); err == nil {
 
 			//return piece response
-			payload := Payload{inMessage.Payload.pieceIndex, []byte{}, 0, int32(len(data)), data}
+			payload := Payload{pieceIndex: inMessage.Payload.pieceIndex, bitField: []byte{}, begin: inMessage.Payload.begin, length: int32(len(data)), block: data}
 			fmt.Printf("Sending piece %d\n", inMessage.Payload.pieceIndex)
 			if err := t.QueueMessage(PIECE, payload); err != nil {
 				return err
 			}
 
-		} else { // could not cater the request
+		} else { // could not cater the request, e.g. it is out of range, the connection is dropped
 			fmt.Println(err)
 			return err
 		}
@@ -346,12 +441,23 @@ func (t *ConnectionManager) ReceiveNextMessage() error {
 
 	case CANCEL:
 		fmt.Println("CANCEL")
-		//implement
+		//the peer no longer wants the block, drop it if it has not been sent yet
+		t.removeQueuedMessage(PIECE, inMessage.Payload.pieceIndex, inMessage.Payload.begin, inMessage.Payload.length)
+	case PORT:
+		//the peer runs a DHT node, it joins our routing table if it answers a ping
+		if addr, ok := t.conn.RemoteAddr().(*net.TCPAddr); ok && t.tInfo.DHT != nil && inMessage.Payload.port != 0 {
+			t.tInfo.DHT.AddNode(&net.UDPAddr{IP: addr.IP, Port: int(inMessage.Payload.port)})
+		}
+	case EXTENDED:
+		//extension protocol message, handled by whichever extension registered its id
+		if err := t.handleExtendedMessage(inMessage.Payload); err != nil {
+			return err
+		}
 	}
 
 	// if we were not interested, we might be now
 	if t.status.ClientInterested == false {
-		if val := t.pieceManager.ComputeRequestQueue(t.descriptor); val == true {
+		if val := t.pieceManager.ComputeRequestQueue(t.descriptor) || t.pieceManager.HasEndgameRequests(t.descriptor); val == true {
 			t.status.ClientInterested = val
 
 			if err := t.QueueMessage(INTERESTED, Payload{}); err != nil {
@@ -362,34 +468,61 @@ func (t *ConnectionManager) ReceiveNextMessage() error {
 
 	}
 
-	//if we are interested in this client and not choked
+	//if we are interested in this client and not choked, keep the request window full
 	if t.status.ClientInterested == true && t.status.PeerChoked == false {
-		//get next piece to download
-		reqPieceID := t.pieceManager.GetNextRequest(t.descriptor)
-		//	fmt.Println(reqPieceID)
-		t.mutex.Lock()
-		t.lastPieceRequest = reqPieceID
-		t.mutex.Unlock()
-		if reqPieceID == -1 {
-			//	fmt.Printf("CONNECT %d, NOT\n", t.descriptor)
-			if err := t.QueueMessage(NOTINTERESTED, Payload{}); err != nil {
-				return err
-			}
-			t.status.ClientInterested = false
+		if err := t.fillRequestWindow(); err != nil {
+			return err
+		}
+	}
 
-		} else {
-			//send a request message for that piece, put in queue
-			//fmt.Printf("Connection %d, REQUEST PIECE %d\n", t.descriptor, reqPieceID)
-			if err := t.QueueMessage(REQUEST, Payload{pieceIndex: int32(reqPieceID), begin: 0, length: int32(t.tInfo.TInfo.PieceLength)}); err != nil {
-				return err
-			}
+	return nil
+}
 
+/*
+* requests blocks until the window of requests in flight is full
+* sends NOTINTERESTED once the peer has nothing more we need and nothing is in flight
+* returns: error
+ */
+func (t *ConnectionManager) fillRequestWindow() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	window := t.requestWindow()
+	for t.pieceManager.NumInFlight(t.descriptor) < window {
+		//get next block to download
+		req := t.pieceManager.GetNextRequest(t.descriptor)
+		if req.Piece == -1 {
+			if t.pieceManager.NumInFlight(t.descriptor) == 0 {
+				if err := t.QueueMessage(NOTINTERESTED, Payload{}); err != nil {
+					return err
+				}
+				t.status.ClientInterested = false
+			}
+			return nil
+		}
+		//send a request message for that block, put in queue
+		if err := t.QueueMessage(REQUEST, Payload{pieceIndex: int32(req.Piece), begin: int32(req.Begin), length: int32(req.Length)}); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
+/*
+* sizes the request window like libtorrent does: enough blocks to cover requestQueueTime seconds at the measured download rate
+* returns: number of block requests to keep in flight
+ */
+func (t *ConnectionManager) requestWindow() int {
+	window := int(t.downloadRate.Rate() * requestQueueTime / BlockSize)
+	if window < minRequestWindow {
+		return minRequestWindow
+	}
+	if window > t.maxRequests {
+		return t.maxRequests
+	}
+	return window
+}
+
 func (t *ConnectionManager) QueueMessage(mType MsgType, payload Payload) error {
 	var msg []byte
 	var err error
@@ -401,12 +534,58 @@ func (t *ConnectionManager) QueueMessage(mType MsgType, payload Payload) error {
 
 	t.msgQueue = append(t.msgQueue, msg)
 	t.queueLock.Unlock()
+	select {
+	case t.queued <- true:
+	default:
+	}
 
 	return nil
 
 }
 
+/*
+* cancels a block requested from the peer, the request is taken back if it is still queued
+* @block: the block to cancel
+* returns: error
+ */
+func (t *ConnectionManager) cancelRequest(block BlockRequest) error {
+	if t.removeQueuedMessage(REQUEST, int32(block.Piece), int32(block.Begin), int32(block.Length)) {
+		return nil
+	}
+	return t.QueueMessage(CANCEL, Payload{pieceIndex: int32(block.Piece), begin: int32(block.Begin), length: int32(block.Length)})
+}
+
+/*
+* removes a queued REQUEST or PIECE message for a block from msgQueue
+* @mType: REQUEST or PIECE
+* @pieceIndex, @begin, @length: the block
+* returns: whether a message was removed
+ */
+func (t *ConnectionManager) removeQueuedMessage(mType MsgType, pieceIndex int32, begin int32, length int32) bool {
+	t.queueLock.Lock()
+	defer t.queueLock.Unlock()
+	for i, queued := range t.msgQueue {
+		msg, err := NewMessage(queued)
+		if err != nil || msg.Mtype != mType || msg.Payload.pieceIndex != pieceIndex || msg.Payload.begin != begin {
+			continue
+		}
+		if mType == PIECE && int32(len(msg.Payload.block)) != length || mType == REQUEST && msg.Payload.length != length {
+			continue
+		}
+		t.msgQueue = append(t.msgQueue[:i], t.msgQueue[i+1:]...)
+		return true
+	}
+	return false
+}
+
 func (t *ConnectionManager) SendNextMessage() error {
+	//blocks another peer delivered first are cancelled
+	for _, block := range t.pieceManager.NextCancels(t.descriptor) {
+		if err := t.cancelRequest(block); err != nil {
+			return err
+		}
+	}
+
 	//check if there are any have broadcasts
 
 	select {
@@ -426,6 +605,11 @@ func (t *ConnectionManager) SendNextMessage() error {
 	if len(t.msgQueue) == 0 {
 
 		t.queueLock.Unlock()
+		//nothing to send, wait a little instead of spinning
+		select {
+		case <-t.queued:
+		case <-time.After(sendIdleWait):
+		}
 		return nil
 	}
 
@@ -433,7 +617,77 @@ func (t *ConnectionManager) SendNextMessage() error {
 	t.msgQueue = t.msgQueue[1:]
 	t.queueLock.Unlock()
 
-	return t.packetHandler.SendArbitraryPacket(t.pWriter, msg)
+	if err := t.packetHandler.SendArbitraryPacket(t.pWriter, msg); err != nil {
+		return err
+	}
+	if getType(msg) == PIECE {
+		//only blocks that went out count, id, index and begin come before the block
+		t.uploadRate.Add(len(msg) - 13)
+		t.pieceManager.AddUploaded(t.descriptor, len(msg)-13)
+	}
+	return nil
+}
+
+/*
+* sets the buckets the connection's traffic goes through, call before starting the connection
+* @limits: upload and download limiters, e.g. the session's, the torrent's and the connection's own
+ */
+func (t *ConnectionManager) SetRateLimits(limits RateLimits) {
+	t.packetHandler.limits = limits
+}
+
+/*
+* chokes or unchokes the peer, queued blocks are dropped when choking since the peer discards its requests
+* @choking: whether to choke the peer
+* returns: error
+ */
+func (t *ConnectionManager) SetChoking(choking bool) error {
+	t.chokeLock.Lock()
+	defer t.chokeLock.Unlock()
+	if t.status.ClientChoked == choking {
+		return nil
+	}
+	t.status.ClientChoked = choking
+	if !choking {
+		fmt.Printf("Sending UNCHOKE to %v\n", t.conn.RemoteAddr())
+		return t.QueueMessage(UNCHOKE, Payload{})
+	}
+
+	fmt.Printf("Sending CHOKE to %v\n", t.conn.RemoteAddr())
+	t.queueLock.Lock()
+	kept := t.msgQueue[:0]
+	for _, queued := range t.msgQueue {
+		if getType(queued) != PIECE {
+			kept = append(kept, queued)
+		}
+	}
+	t.msgQueue = kept
+	t.queueLock.Unlock()
+	return t.QueueMessage(CHOKE, Payload{})
+}
+
+// IsChoking reports whether we are choking the peer
+func (t *ConnectionManager) IsChoking() bool {
+	t.chokeLock.Lock()
+	defer t.chokeLock.Unlock()
+	return t.status.ClientChoked
+}
+
+// IsPeerInterested reports whether the peer wants to download from us
+func (t *ConnectionManager) IsPeerInterested() bool {
+	t.chokeLock.Lock()
+	defer t.chokeLock.Unlock()
+	return t.status.PeerInterested
+}
+
+// DownloadRate is the payload bytes per second we receive from the peer
+func (t *ConnectionManager) DownloadRate() float64 {
+	return t.downloadRate.Rate()
+}
+
+// UploadRate is the payload bytes per second we send to the peer
+func (t *ConnectionManager) UploadRate() float64 {
+	return t.uploadRate.Rate()
 }
 
 func (t *ConnectionManager) GetConnectionStatus() ConnectionStatus {
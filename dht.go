@@ -0,0 +1,777 @@
+package main
+
+/*
+* mainline DHT (BEP 5), finds peers for a torrent without a tracker
+* a kademlia node speaking KRPC, bencoded messages over UDP: ping, find_node, get_peers and announce_peer
+* nodes we know are kept in a routing table of k-buckets, saved to a cache file so the next start
+* does not depend on the bootstrap routers
+ */
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	dhtK                = 8                // nodes per bucket, and the nodes a lookup ends with
+	dhtAlpha            = 3                // queries a lookup has in flight at once
+	dhtQueryTimeout     = 2 * time.Second  // time a node has to answer a query
+	dhtMaxFailures      = 2                // unanswered queries in a row before a node is dropped
+	dhtNodeExpiry       = 15 * time.Minute // a node not heard of for this long may be replaced by a new one
+	dhtSecretInterval   = 5 * time.Minute  // tokens stay valid for one to two intervals
+	dhtPeerExpiry       = 30 * time.Minute // announced peers are forgotten after this long
+	dhtMaxPeersPerHash  = 100              // peers kept, and handed out, per info hash
+	dhtMaintainInterval = time.Minute
+	dhtMaxLookupRounds  = 20
+)
+
+// dhtBootstrapNodes are asked for nodes while the routing table is close to empty
+var dhtBootstrapNodes = []string{"router.bittorrent.com:6881", "router.utorrent.com:6881", "dht.transmissionbt.com:6881"}
+
+//krpcArgs are the arguments of a query
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int64  `bencode:"port,omitempty"`
+	ImpliedPort int64  `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+//krpcReply is the content of a response
+type krpcReply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // compact node info
+	Values []string `bencode:"values,omitempty"` // compact peers
+	Token  string   `bencode:"token,omitempty"`
+}
+
+//krpcMessage is a KRPC query ("q"), response ("r") or error ("e")
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *krpcArgs     `bencode:"a,omitempty"`
+	R *krpcReply    `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+}
+
+//dhtCache is the bencoded content of the node cache file
+type dhtCache struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"` // compact node info
+}
+
+//dhtNode is a node of the DHT
+type dhtNode struct {
+	ID       string
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	Failures int
+}
+
+/*
+* the k-buckets, bucket i holds the nodes whose id shares exactly i leading bits with ours
+ */
+type routingTable struct {
+	own     string
+	buckets [160][]*dhtNode // least recently seen first
+	lock    *sync.Mutex
+}
+
+// pendingQuery is a query waiting for its response, only the queried node may answer it
+type pendingQuery struct {
+	addr     *net.UDPAddr
+	response chan krpcMessage
+}
+
+// DHT is our node in the mainline DHT
+type DHT struct {
+	id    string
+	conn  *net.UDPConn
+	table *routingTable
+
+	pending map[string]pendingQuery //queries waiting for their response, by transaction id
+	nextTID uint16
+
+	secret     []byte //tokens are a hash of the querying address and a secret
+	prevSecret []byte //tokens made with the previous secret are still accepted
+
+	peers map[string]map[string]time.Time //info hash -> compact peer -> time of its announce
+
+	lock *sync.Mutex
+
+	cachePath string
+	done      chan bool
+}
+
+/*
+* starts a DHT node, nodes from the cache file are added to the routing table, Bootstrap fills it up
+* @port: UDP port of the node, 0 picks a free one
+* @cachePath: file our node id and known nodes are kept in, empty for none
+* returns: the node, error if the port cannot be opened
+ */
+func NewDHT(port int, cachePath string) (*DHT, error) {
+	d := &DHT{
+		pending:   make(map[string]pendingQuery),
+		peers:     make(map[string]map[string]time.Time),
+		lock:      &sync.Mutex{},
+		cachePath: cachePath,
+		done:      make(chan bool),
+	}
+	d.secret = randomBytes(20)
+	d.prevSecret = d.secret
+
+	var cache dhtCache
+	if cachePath != "" {
+		if data, err := ioutil.ReadFile(cachePath); err == nil {
+			if err := bencode.DecodeBytes(data, &cache); err != nil {
+				fmt.Println("Ignoring DHT node cache:", err)
+				cache = dhtCache{}
+			}
+		}
+	}
+	d.id = cache.ID
+	if len(d.id) != 20 {
+		d.id = string(randomBytes(20))
+	}
+	d.table = newRoutingTable(d.id)
+	for _, node := range decodeCompactNodes(cache.Nodes) {
+		d.table.insert(node.ID, node.Addr)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	go d.serve()
+	go d.maintain()
+	return d, nil
+}
+
+/*
+* returns: the UDP port of the node, sent to peers in PORT messages
+ */
+func (d *DHT) Port() int {
+	return d.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+/*
+* saves the node cache and stops the node
+* returns: error
+ */
+func (d *DHT) Close() error {
+	err := d.saveCache()
+	close(d.done)
+	d.conn.Close()
+	return err
+}
+
+/*
+* looks up our own id, which fills the routing table with the nodes around us
+* the bootstrap routers are asked as well while the table is close to empty
+ */
+func (d *DHT) Bootstrap() {
+	d.lookup(d.id, "find_node", d.bootstrapAddrs())
+	fmt.Printf("DHT: %d nodes in the routing table\n", d.table.size())
+}
+
+/*
+* HELPER
+* returns: the addresses of the bootstrap routers while the routing table is close to empty, nil otherwise
+ */
+func (d *DHT) bootstrapAddrs() []*net.UDPAddr {
+	if d.table.size() >= dhtK {
+		return nil
+	}
+	var addrs []*net.UDPAddr
+	for _, host := range dhtBootstrapNodes {
+		if addr, err := net.ResolveUDPAddr("udp4", host); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+/*
+* pings a node a peer told us about in a PORT message, it is added to the routing table if it answers
+* @addr: the node
+ */
+func (d *DHT) AddNode(addr *net.UDPAddr) {
+	go d.query(addr, "ping", krpcArgs{})
+}
+
+/*
+* finds peers for a torrent, and announces that we have it too
+* @infoHash: the torrent
+* @port: TCP port peers reach us on, 0 to not announce
+* returns: the peers found
+ */
+func (d *DHT) GetPeers(infoHash string, port int) []Peer {
+	closest, tokens, values := d.lookup(infoHash, "get_peers", d.bootstrapAddrs())
+
+	if port > 0 {
+		for _, node := range closest {
+			if token, ok := tokens[node.ID]; ok {
+				go d.query(node.Addr, "announce_peer", krpcArgs{InfoHash: infoHash, Port: int64(port), Token: token})
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var peers []Peer
+	for _, value := range values {
+		if seen[value] || len(value) != 6 {
+			continue
+		}
+		seen[value] = true
+		peers = append(peers, parseCompactPeers([]byte(value), 4)...)
+	}
+	return peers
+}
+
+/*
+* HELPER
+* iterative kademlia lookup, queries ever closer nodes to the target until the closest ones all answered
+* @target: node id or info hash to look up
+* @method: find_node or get_peers
+* @extra: nodes of unknown id to ask as well, e.g. the bootstrap routers
+* returns: the closest nodes that answered, the tokens they gave, the peers they returned
+ */
+func (d *DHT) lookup(target string, method string, extra []*net.UDPAddr) ([]*dhtNode, map[string]string, []string) {
+	type result struct {
+		node  *dhtNode
+		reply krpcReply
+		err   error
+	}
+
+	var candidates []*dhtNode
+	known := make(map[string]bool) //addresses already in candidates
+	add := func(node *dhtNode) {
+		if node.ID == d.id || known[node.Addr.String()] {
+			return
+		}
+		known[node.Addr.String()] = true
+		candidates = append(candidates, node)
+	}
+	for _, addr := range extra {
+		add(&dhtNode{Addr: addr})
+	}
+	for _, node := range d.table.closest(target, dhtK) {
+		add(node)
+	}
+
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+	var responded []*dhtNode
+	tokens := make(map[string]string)
+	var values []string
+	args := krpcArgs{Target: target}
+	if method == "get_peers" {
+		args = krpcArgs{InfoHash: target}
+	}
+
+	for round := 0; round < dhtMaxLookupRounds; round++ {
+		//nodes of unknown id (bootstrap routers) go first, then the closest ones
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].ID == "" || candidates[j].ID == "" {
+				return candidates[i].ID == "" && candidates[j].ID != ""
+			}
+			return dhtCloser(target, candidates[i].ID, candidates[j].ID)
+		})
+		//done once the k closest nodes that answered, or have yet to, have all been queried
+		var batch []*dhtNode
+		closeCount := 0
+		for _, node := range candidates {
+			if failed[node.Addr.String()] {
+				continue
+			}
+			if node.ID != "" {
+				if closeCount >= dhtK {
+					break
+				}
+				closeCount++
+			}
+			if !queried[node.Addr.String()] && len(batch) < dhtAlpha {
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, node := range batch {
+			queried[node.Addr.String()] = true
+			go func(node *dhtNode) {
+				reply, err := d.query(node.Addr, method, args)
+				results <- result{node, reply, err}
+			}(node)
+		}
+		for range batch {
+			res := <-results
+			if res.err != nil {
+				failed[res.node.Addr.String()] = true
+				continue
+			}
+			res.node.ID = res.reply.ID
+			responded = append(responded, res.node)
+			if res.reply.Token != "" {
+				tokens[res.reply.ID] = res.reply.Token
+			}
+			values = append(values, res.reply.Values...)
+			for _, node := range decodeCompactNodes(res.reply.Nodes) {
+				add(node)
+			}
+		}
+	}
+
+	sort.Slice(responded, func(i, j int) bool {
+		return dhtCloser(target, responded[i].ID, responded[j].ID)
+	})
+	if len(responded) > dhtK {
+		responded = responded[:dhtK]
+	}
+	return responded, tokens, values
+}
+
+/*
+* HELPER
+* sends a query and waits for its response
+* nodes that answer are added to the routing table, nodes that keep failing are dropped from it
+* @addr: the node
+* @method: the query
+* @args: its arguments, our id is filled in
+* returns: the response, error if the node did not answer or answered with an error
+ */
+func (d *DHT) query(addr *net.UDPAddr, method string, args krpcArgs) (krpcReply, error) {
+	args.ID = d.id
+	d.lock.Lock()
+	d.nextTID++
+	tid := string([]byte{byte(d.nextTID >> 8), byte(d.nextTID)})
+	response := make(chan krpcMessage, 1)
+	d.pending[tid] = pendingQuery{addr: addr, response: response}
+	d.lock.Unlock()
+	defer func() {
+		d.lock.Lock()
+		delete(d.pending, tid)
+		d.lock.Unlock()
+	}()
+
+	if err := d.send(addr, krpcMessage{T: tid, Y: "q", Q: method, A: &args}); err != nil {
+		return krpcReply{}, err
+	}
+	select {
+	case msg := <-response:
+		if msg.Y == "e" || msg.R == nil {
+			return krpcReply{}, fmt.Errorf("DHT: %v answered %s with an error: %v", addr, method, msg.E)
+		}
+		if len(msg.R.ID) != 20 {
+			return krpcReply{}, errors.New("DHT: response without a node id")
+		}
+		d.table.insert(msg.R.ID, addr)
+		return *msg.R, nil
+	case <-time.After(dhtQueryTimeout):
+		d.table.failed(addr)
+		return krpcReply{}, fmt.Errorf("DHT: %v did not answer %s", addr, method)
+	case <-d.done:
+		return krpcReply{}, errors.New("DHT: closed")
+	}
+}
+
+/*
+* HELPER
+* bencodes a message and sends it
+ */
+func (d *DHT) send(addr *net.UDPAddr, msg krpcMessage) error {
+	data, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+/*
+* HELPER
+* reads messages until the node is closed, answers queries and hands responses to the waiting query
+ */
+func (d *DHT) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+				continue
+			}
+		}
+		var msg krpcMessage
+		if err := bencode.DecodeBytes(buf[:n], &msg); err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			d.handleQuery(msg, addr)
+		case "r", "e":
+			d.lock.Lock()
+			pending, ok := d.pending[msg.T]
+			d.lock.Unlock()
+			// transaction ids are short, a response from any other address is not the one we wait for
+			if ok && pending.addr.IP.Equal(addr.IP) && pending.addr.Port == addr.Port {
+				select {
+				case pending.response <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+/*
+* HELPER
+* answers a query from another node
+* @msg: the query
+* @addr: the node that sent it
+ */
+func (d *DHT) handleQuery(msg krpcMessage, addr *net.UDPAddr) {
+	if msg.A == nil || len(msg.A.ID) != 20 {
+		d.send(addr, krpcMessage{T: msg.T, Y: "e", E: []interface{}{203, "Protocol Error"}})
+		return
+	}
+	args := msg.A
+	d.table.insert(args.ID, addr)
+	reply := &krpcReply{ID: d.id}
+	//maintain rotates the secrets
+	d.lock.Lock()
+	secret, prevSecret := d.secret, d.prevSecret
+	d.lock.Unlock()
+
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		reply.Nodes = encodeCompactNodes(d.table.closest(args.Target, dhtK))
+	case "get_peers":
+		reply.Token = d.token(addr.IP, secret)
+		if reply.Values = d.storedPeers(args.InfoHash); len(reply.Values) == 0 {
+			reply.Nodes = encodeCompactNodes(d.table.closest(args.InfoHash, dhtK))
+		}
+	case "announce_peer":
+		if args.Token != d.token(addr.IP, secret) && args.Token != d.token(addr.IP, prevSecret) {
+			d.send(addr, krpcMessage{T: msg.T, Y: "e", E: []interface{}{203, "Bad Token"}})
+			return
+		}
+		port := int(args.Port)
+		if args.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		d.storePeer(args.InfoHash, addr.IP, port)
+	default:
+		d.send(addr, krpcMessage{T: msg.T, Y: "e", E: []interface{}{204, "Method Unknown"}})
+		return
+	}
+	d.send(addr, krpcMessage{T: msg.T, Y: "r", R: reply})
+}
+
+/*
+* HELPER
+* every dhtMaintainInterval: rotates the token secret, forgets old announces, saves the cache
+* and bootstraps again while the routing table is close to empty
+ */
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(dhtMaintainInterval)
+	defer ticker.Stop()
+	rotated := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.done:
+			return
+		}
+		d.lock.Lock()
+		if time.Since(rotated) >= dhtSecretInterval {
+			d.prevSecret = d.secret
+			d.secret = randomBytes(20)
+			rotated = time.Now()
+		}
+		for infoHash, peers := range d.peers {
+			for peer, announced := range peers {
+				if time.Since(announced) > dhtPeerExpiry {
+					delete(peers, peer)
+				}
+			}
+			if len(peers) == 0 {
+				delete(d.peers, infoHash)
+			}
+		}
+		d.lock.Unlock()
+
+		if d.table.size() < dhtK {
+			d.Bootstrap()
+		}
+		if err := d.saveCache(); err != nil {
+			fmt.Println("Unable to save the DHT node cache:", err)
+		}
+	}
+}
+
+/*
+* HELPER
+* returns: the token a node at ip has to send back with announce_peer
+ */
+func (d *DHT) token(ip net.IP, secret []byte) string {
+	hash := sha1.Sum(append(append([]byte(nil), secret...), ip.To16()...))
+	return string(hash[:8])
+}
+
+/*
+* HELPER
+* remembers a peer that announced itself for a torrent
+ */
+func (d *DHT) storePeer(infoHash string, ip net.IP, port int) {
+	ip4 := ip.To4()
+	if len(infoHash) != 20 || ip4 == nil || port <= 0 || port > 65535 {
+		return
+	}
+	compact := make([]byte, 6)
+	copy(compact, ip4)
+	binary.BigEndian.PutUint16(compact[4:], uint16(port))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	peers, ok := d.peers[infoHash]
+	if !ok {
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if _, known := peers[string(compact)]; known || len(peers) < dhtMaxPeersPerHash {
+		peers[string(compact)] = time.Now()
+	}
+}
+
+/*
+* HELPER
+* returns: compact peers announced for a torrent
+ */
+func (d *DHT) storedPeers(infoHash string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var values []string
+	for peer := range d.peers[infoHash] {
+		values = append(values, peer)
+	}
+	return values
+}
+
+/*
+* HELPER
+* writes our id and the nodes of the routing table to the cache file
+ */
+func (d *DHT) saveCache() error {
+	if d.cachePath == "" {
+		return nil
+	}
+	data, err := bencode.EncodeBytes(dhtCache{ID: d.id, Nodes: encodeCompactNodes(d.table.all())})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.cachePath, data)
+}
+
+/*
+* create an empty routing table
+* @own: our node id
+ */
+func newRoutingTable(own string) *routingTable {
+	return &routingTable{own: own, lock: &sync.Mutex{}}
+}
+
+/*
+* HELPER
+* returns: the bucket a node id belongs in, -1 for our own id
+ */
+func (rt *routingTable) bucketIndex(id string) int {
+	for i := 0; i < len(id) && i < len(rt.own); i++ {
+		if x := id[i] ^ rt.own[i]; x != 0 {
+			n := 0
+			for x&0x80 == 0 {
+				x <<= 1
+				n++
+			}
+			return i*8 + n
+		}
+	}
+	return -1
+}
+
+/*
+* notes that a node is alive, adding it if its bucket has room
+* a full bucket only takes it in place of a node not heard of for dhtNodeExpiry
+* @id: the node id
+* @addr: the node's address
+ */
+func (rt *routingTable) insert(id string, addr *net.UDPAddr) {
+	index := rt.bucketIndex(id)
+	if len(id) != 20 || index < 0 {
+		return
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	bucket := rt.buckets[index]
+	for i, node := range bucket {
+		if node.ID == id {
+			node.Addr = addr
+			node.LastSeen = time.Now()
+			node.Failures = 0
+			//most recently seen go last
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return
+		}
+	}
+	node := &dhtNode{ID: id, Addr: addr, LastSeen: time.Now()}
+	if len(bucket) < dhtK {
+		rt.buckets[index] = append(bucket, node)
+		return
+	}
+	if time.Since(bucket[0].LastSeen) > dhtNodeExpiry {
+		rt.buckets[index] = append(bucket[1:len(bucket):len(bucket)], node)
+	}
+}
+
+/*
+* notes that a node did not answer, it is dropped after dhtMaxFailures in a row
+* @addr: the node's address
+ */
+func (rt *routingTable) failed(addr *net.UDPAddr) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	for index, bucket := range rt.buckets {
+		for i, node := range bucket {
+			if node.Addr.String() != addr.String() {
+				continue
+			}
+			node.Failures++
+			if node.Failures >= dhtMaxFailures {
+				rt.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+/*
+* returns: up to n nodes closest to target
+ */
+func (rt *routingTable) closest(target string, n int) []*dhtNode {
+	nodes := rt.all()
+	sort.Slice(nodes, func(i, j int) bool {
+		return dhtCloser(target, nodes[i].ID, nodes[j].ID)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+/*
+* returns: copies of every node in the table
+ */
+func (rt *routingTable) all() []*dhtNode {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	var nodes []*dhtNode
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			copied := *node
+			nodes = append(nodes, &copied)
+		}
+	}
+	return nodes
+}
+
+/*
+* returns: number of nodes in the table
+ */
+func (rt *routingTable) size() int {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+/*
+* HELPER
+* returns: whether a is closer to target than b by XOR distance
+ */
+func dhtCloser(target string, a string, b string) bool {
+	for i := 0; i < len(target) && i < len(a) && i < len(b); i++ {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+/*
+* HELPER
+* packs nodes as compact node info: 20 byte id, 4 byte IPv4 address, 2 byte port
+* nodes without an IPv4 address are skipped
+ */
+func encodeCompactNodes(nodes []*dhtNode) string {
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if len(node.ID) != 20 || ip == nil {
+			continue
+		}
+		buf.WriteString(node.ID)
+		buf.Write(ip)
+		binary.Write(&buf, binary.BigEndian, uint16(node.Addr.Port))
+	}
+	return buf.String()
+}
+
+/*
+* HELPER
+* unpacks compact node info
+ */
+func decodeCompactNodes(data string) []*dhtNode {
+	var nodes []*dhtNode
+	for i := 0; i+26 <= len(data); i += 26 {
+		ip := net.IP([]byte(data[i+20 : i+24]))
+		port := binary.BigEndian.Uint16([]byte(data[i+24 : i+26]))
+		if port == 0 {
+			continue
+		}
+		nodes = append(nodes, &dhtNode{ID: data[i : i+20], Addr: &net.UDPAddr{IP: ip, Port: int(port)}})
+	}
+	return nodes
+}
+
+/*
+* HELPER
+* returns: n random bytes
+ */
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
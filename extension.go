@@ -0,0 +1,182 @@
+package main
+
+/*
+* extension protocol (BEP 10)
+* extensions such as ut_metadata or ut_pex register here and receive their messages
+* from ConnectionManager without it knowing about them
+ */
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/zeebo/bencode"
+)
+
+// ExtendedHandshake is the bencoded payload of extended message 0
+type ExtendedHandshake struct {
+	M            map[string]int64 `bencode:"m"`                       // extension name -> message id
+	MetadataSize int64            `bencode:"metadata_size,omitempty"` // size of the info dictionary (BEP 9)
+	V            string           `bencode:"v,omitempty"`             // client name and version
+	P            int64            `bencode:"p,omitempty"`             // port the sender listens on
+}
+
+// Extension is a message type carried over the extension protocol
+type Extension interface {
+	// Name is the key the extension is advertised under in the m dictionary
+	Name() string
+	// ExtendHandshake adds the extension's own keys to our extended handshake
+	ExtendHandshake(hs *ExtendedHandshake)
+	// HandleMessage is called with the payload of each message the peer sends for this extension
+	HandleMessage(t *ConnectionManager, payload []byte) error
+}
+
+// ExtensionRegistry maps the extensions we support to the message ids we advertise for them
+type ExtensionRegistry struct {
+	extensions []Extension // local message id is index + 1
+	lock       *sync.RWMutex
+}
+
+/*
+* create an empty registry
+* returns: the new registry
+ */
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{lock: &sync.RWMutex{}}
+}
+
+/*
+* adds an extension, replacing any already registered under the same name
+* @ext: the extension
+* returns: the message id peers should use to send us messages for it
+ */
+func (r *ExtensionRegistry) Register(ext Extension) byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, e := range r.extensions {
+		if e.Name() == ext.Name() {
+			r.extensions[i] = ext
+			return byte(i + 1)
+		}
+	}
+	r.extensions = append(r.extensions, ext)
+	return byte(len(r.extensions))
+}
+
+/*
+* finds the extension for a message id we advertised
+* @id: local message id
+* returns: the extension or nil
+ */
+func (r *ExtensionRegistry) Lookup(id byte) Extension {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if id == 0 || int(id) > len(r.extensions) {
+		return nil
+	}
+	return r.extensions[id-1]
+}
+
+/*
+* builds our extended handshake advertising every registered extension
+* returns: the bencoded handshake, error
+ */
+func (r *ExtensionRegistry) Handshake() ([]byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	hs := ExtendedHandshake{M: make(map[string]int64), V: ClientVersion}
+	for i, ext := range r.extensions {
+		hs.M[ext.Name()] = int64(i + 1)
+		ext.ExtendHandshake(&hs)
+	}
+	return bencode.EncodeBytes(hs)
+}
+
+/*
+* sends our extended handshake to the peer, only done when the peer set the extension bit
+* returns: error
+ */
+func (t *ConnectionManager) sendExtendedHandshake() error {
+	payload, err := t.tInfo.Extensions.Handshake()
+	if err != nil {
+		return err
+	}
+	msg, err := CreateMessage(EXTENDED, Payload{extendedID: 0, block: payload})
+	if err != nil {
+		return err
+	}
+	return t.packetHandler.SendArbitraryPacket(t.pWriter, msg)
+}
+
+/*
+* dispatches an extension protocol message, either the peer's handshake or a registered extension
+* @payload: payload of the EXTENDED message
+* returns: error
+ */
+func (t *ConnectionManager) handleExtendedMessage(payload Payload) error {
+	if payload.extendedID == 0 {
+		var hs ExtendedHandshake
+		if err := bencode.DecodeBytes(payload.block, &hs); err != nil {
+			return err
+		}
+		t.extLock.Lock()
+		t.peerHandshake = hs
+		t.extLock.Unlock()
+		return nil
+	}
+
+	if t.tInfo.Extensions == nil {
+		return nil
+	}
+	ext := t.tInfo.Extensions.Lookup(payload.extendedID)
+	if ext == nil { // not something we advertised, ignore it
+		return nil
+	}
+	return ext.HandleMessage(t, payload.block)
+}
+
+/*
+* checks whether the peer advertised an extension in its handshake
+* @name: extension name
+* returns: the peer's message id for it and whether it exists
+ */
+func (t *ConnectionManager) PeerExtensionID(name string) (byte, bool) {
+	t.extLock.Lock()
+	defer t.extLock.Unlock()
+	id, ok := t.peerHandshake.M[name]
+	if !ok || id <= 0 || id > 255 {
+		return 0, false
+	}
+	return byte(id), true
+}
+
+/*
+* finds where an incoming peer accepts connections, from its address and the port in its extended handshake
+* returns: host:port, "" if the peer did not send its port
+ */
+func (t *ConnectionManager) PeerListenAddr() string {
+	t.extLock.Lock()
+	port := t.peerHandshake.P
+	t.extLock.Unlock()
+	addr, ok := t.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || port <= 0 || port > 65535 {
+		return ""
+	}
+	return net.JoinHostPort(addr.IP.String(), strconv.FormatInt(port, 10))
+}
+
+/*
+* queues an extension message for the peer using the id the peer assigned to the extension
+* @name: extension name
+* @payload: the extension's payload
+* returns: error
+ */
+func (t *ConnectionManager) QueueExtendedMessage(name string, payload []byte) error {
+	id, ok := t.PeerExtensionID(name)
+	if !ok {
+		return errors.New("QueueExtendedMessage: peer does not support " + name)
+	}
+	return t.QueueMessage(EXTENDED, Payload{extendedID: id, block: payload})
+}
@@ -8,7 +8,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 type status int
@@ -22,21 +24,38 @@ const (
 	WRITING status = iota
 )
 
+//DataFile is a single file on disk and the range of the torrent's bytes it holds
+type DataFile struct {
+	Path   string
+	Offset int64 // position of the file's first byte in the torrent
+	Length int64
+	File   *os.File
+}
+
+//FileStamp is the size and modification time of a data file, saved to notice changes made while we were not running
+type FileStamp struct {
+	Size    int64 `bencode:"size"`
+	ModTime int64 `bencode:"mtime"` // unix nanoseconds
+}
+
 //FileWriter is the struct containing information writing to a file
+//Pieces are laid out end to end across DataFiles, so one piece may span several files
 type FileWriter struct {
-	Info         *InfoDict
-	DataFile     *os.File
-	Status       status
-	MetaDataFile *os.File
+	Info       *InfoDict
+	DataFiles  []DataFile
+	Status     status
+	ResumePath string // where the resume data of the download is saved, empty if there is none
+	Existed    bool   // some data file was already on disk when the FileWriter was created
 }
 
 //NewFileWriter Create initializes a new File Writer write to a particular file based on info
 //in the Info dictionary
-func NewFileWriter(tInfo *InfoDict, fileName string, metaFileLength int64) FileWriter {
+func NewFileWriter(tInfo *InfoDict, fileName string) FileWriter {
 	var f FileWriter
 	f.Info = tInfo
 
 	dirName := strings.Split(fileName, ".")[0]
+	dataPath, resumePath := downloadPaths(tInfo, fileName)
 	if _, err := os.Stat(dirName); err != nil {
 		if os.IsNotExist(err) { // directory does not exist create it
 			if err := os.Mkdir(dirName, 0755); err != nil {
@@ -47,13 +66,122 @@ func NewFileWriter(tInfo *InfoDict, fileName string, metaFileLength int64) FileW
 
 	}
 
-	f.DataFile = f.OpenFile(filepath.Join(dirName, fileName), int64(tInfo.Length))
-	f.MetaDataFile = f.OpenFile(filepath.Join(dirName, "."+fileName+".meta"), metaFileLength)
+	if len(tInfo.Files) == 0 {
+		f.DataFiles = []DataFile{f.openDataFile(dataPath, 0, int64(tInfo.Length))}
+	} else {
+		// multi-file torrents go in a directory named after the torrent
+		if !safePathPart(tInfo.Name) {
+			log.Fatal("Unsafe torrent name: ", tInfo.Name)
+		}
+		var offset int64
+		for _, file := range tInfo.Files {
+			if len(file.Path) == 0 {
+				log.Fatal("Empty path in torrent files list")
+			}
+			for _, part := range file.Path {
+				if !safePathPart(part) {
+					log.Fatal("Unsafe path in torrent files list: ", file.Path)
+				}
+			}
+			path := filepath.Join(append([]string{dataPath}, file.Path...)...)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				log.Fatal("Unable to create directory for torrent file\n", err)
+			}
+			f.DataFiles = append(f.DataFiles, f.openDataFile(path, offset, int64(file.Length)))
+			offset += int64(file.Length)
+		}
+	}
+	f.ResumePath = resumePath
 
 	f.Status = CREATED
 	return f
 }
 
+//OpenFileWriter opens data that is already on disk, e.g. to seed it
+//dataPath is the file of a single file torrent or the directory holding the files of a multi file torrent
+//every file must exist with the length the torrent gives it, there is no resume file
+func OpenFileWriter(tInfo *InfoDict, dataPath string) (FileWriter, error) {
+	var f FileWriter
+	f.Info = tInfo
+
+	type entry struct {
+		path   string
+		length int64
+	}
+	var entries []entry
+	if len(tInfo.Files) == 0 {
+		entries = append(entries, entry{dataPath, int64(tInfo.Length)})
+	} else {
+		for _, file := range tInfo.Files {
+			if len(file.Path) == 0 {
+				return f, errors.New("OpenFileWriter: empty path in torrent files list")
+			}
+			for _, part := range file.Path {
+				if !safePathPart(part) {
+					return f, fmt.Errorf("OpenFileWriter: unsafe path in torrent files list: %v", file.Path)
+				}
+			}
+			entries = append(entries, entry{filepath.Join(append([]string{dataPath}, file.Path...)...), int64(file.Length)})
+		}
+	}
+
+	var offset int64
+	var missing []string
+	for _, e := range entries {
+		file, err := os.Open(e.path)
+		if os.IsNotExist(err) {
+			missing = append(missing, e.path)
+			continue
+		}
+		if err != nil {
+			f.Finish()
+			return f, err
+		}
+		f.DataFiles = append(f.DataFiles, DataFile{Path: e.path, Offset: offset, Length: e.length, File: file})
+		if info, err := file.Stat(); err != nil || info.Size() != e.length {
+			f.Finish()
+			return f, fmt.Errorf("OpenFileWriter: %s does not have the length given in the torrent", e.path)
+		}
+		offset += e.length
+	}
+	if len(missing) > 0 {
+		f.Finish()
+		return f, fmt.Errorf("OpenFileWriter: missing %s", strings.Join(missing, ", "))
+	}
+	f.Status = CREATED
+	return f, nil
+}
+
+/*
+* HELPER
+* where NewFileWriter lays out a download, in a directory named after the output file
+* @fileName: output file of the download
+* returns: the file of a single file torrent or the directory of a multi file torrent, the path of the resume data
+ */
+func downloadPaths(tInfo *InfoDict, fileName string) (dataPath string, resumePath string) {
+	dirName := strings.Split(fileName, ".")[0]
+	if len(tInfo.Files) == 0 {
+		dataPath = filepath.Join(dirName, fileName)
+	} else {
+		dataPath = filepath.Join(dirName, tInfo.Name)
+	}
+	return dataPath, filepath.Join(dirName, "."+fileName+".resume")
+}
+
+/*
+* HELPER
+* checks a name from the torrent is a single path element that stays inside the download directory
+* @part: the torrent name or one element of a file's path
+* returns: false for "", ".", ".." and names with a path separator
+ */
+func safePathPart(part string) bool {
+	return part != "" && part != "." && part != ".." && !strings.ContainsAny(part, "/"+string(os.PathSeparator))
+}
+
+func (f *FileWriter) openDataFile(path string, offset int64, length int64) DataFile {
+	return DataFile{Path: path, Offset: offset, Length: length, File: f.OpenFile(path, length)}
+}
+
 func (f *FileWriter) OpenFile(path string, size int64) *os.File {
 	if _, err := os.Stat(path); err != nil {
 		if os.IsNotExist(err) { // file does not exist create it
@@ -71,6 +199,7 @@ func (f *FileWriter) OpenFile(path string, size int64) *os.File {
 	}
 	// file exists just open it
 	fmt.Println(path)
+	f.Existed = true
 	file, err := os.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
 		log.Fatal("Error opening existing file in FileWriter\n", err)
@@ -96,17 +225,65 @@ func (f *FileWriter) Write(data []byte, index int) error {
 		//	fmt.Println("MATCHED")
 	}
 
-	_, err := f.DataFile.WriteAt(data, int64(index*f.Info.PieceLength))
+	_, err := f.WriteAt(data, int64(index)*int64(f.Info.PieceLength))
 	//	fmt.Println(err)
 	return err
 }
 
 func (f *FileWriter) Read(index int32) (error, []byte) {
-	data := make([]byte, f.Info.PieceLength, f.Info.PieceLength)
-	_, err := f.DataFile.ReadAt(data, int64(index*int32(f.Info.PieceLength)))
+	data := make([]byte, f.Info.PieceSize(int(index)))
+	_, err := f.ReadAt(data, int64(index)*int64(f.Info.PieceLength))
 	return err, data
 }
 
+//WriteAt writes data at offset in the torrent, splitting it across the files it overlaps
+func (f *FileWriter) WriteAt(data []byte, offset int64) (int, error) {
+	return f.spanFiles(data, offset, func(file *os.File, buf []byte, off int64) (int, error) {
+		return file.WriteAt(buf, off)
+	})
+}
+
+//ReadAt reads len(data) bytes at offset in the torrent, gathering them from the files it overlaps
+func (f *FileWriter) ReadAt(data []byte, offset int64) (int, error) {
+	return f.spanFiles(data, offset, func(file *os.File, buf []byte, off int64) (int, error) {
+		return file.ReadAt(buf, off)
+	})
+}
+
+/*
+* HELPER
+* maps the torrent range [offset, offset+len(data)) onto the data files and applies op to each part
+* returns: bytes handled, error
+ */
+func (f *FileWriter) spanFiles(data []byte, offset int64, op func(*os.File, []byte, int64) (int, error)) (int, error) {
+	total := 0
+	for _, df := range f.DataFiles {
+		if total == len(data) {
+			break
+		}
+		pos := offset + int64(total)
+		if pos >= df.Offset+df.Length || df.Length == 0 {
+			continue
+		}
+		if pos < df.Offset {
+			break
+		}
+		end := int64(len(data) - total)
+		if remaining := df.Offset + df.Length - pos; end > remaining {
+			end = remaining
+		}
+		n, err := op(df.File, data[total:total+int(end)], pos-df.Offset)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	if total != len(data) {
+		return total, io.ErrUnexpectedEOF
+	}
+	return total, nil
+}
+
 func (f *FileWriter) checkSHA1(data []byte, index int) bool {
 	// compute the hash of data
 	hash := sha1.New()
@@ -116,14 +293,70 @@ func (f *FileWriter) checkSHA1(data []byte, index int) bool {
 	return strings.Compare(dataHash, pieceHash) == 0
 }
 
+//CheckPiece reads a piece back and compares it with its SHA1 hash from the torrent
+func (f *FileWriter) CheckPiece(index int) (bool, error) {
+	err, data := f.Read(int32(index))
+	if err != nil {
+		return false, err
+	}
+	return f.checkSHA1(data, index), nil
+}
+
+//Recheck hashes every piece again, spread over all CPU cores, and returns the bitfield of the pieces that match
+//pieces that cannot be read, e.g. because a file was truncated, count as missing
+func (f *FileWriter) Recheck() []byte {
+	numPieces := f.Info.NumPieces()
+	bitField := make([]byte, (numPieces+7)/8)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for worker := 0; worker < runtime.NumCPU(); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if ok, _ := f.CheckPiece(index); ok {
+					lock.Lock()
+					bitField[index/8] |= 1 << (7 - uint(index%8))
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for index := 0; index < numPieces; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return bitField
+}
+
+//Stamps returns the current size and modification time of every data file
+func (f *FileWriter) Stamps() ([]FileStamp, error) {
+	stamps := make([]FileStamp, len(f.DataFiles))
+	for i, df := range f.DataFiles {
+		info, err := df.File.Stat()
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = FileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	}
+	return stamps, nil
+}
+
 // Delete destroys the file that has been created and the FileWriter
 func (f *FileWriter) Delete() error {
 	if f == nil {
 		return errors.New("Undefined FileWriter\n")
 	}
-	err := os.Remove(f.Info.Name)
-	if err != nil { // set f to nil only if error is nil
-		f.DataFile.Close()
+	var err error
+	for _, df := range f.DataFiles {
+		df.File.Close()
+		if rmErr := os.Remove(df.Path); rmErr != nil {
+			err = rmErr
+		}
+	}
+	if err == nil { // set f to nil only if error is nil
 		f = nil
 	}
 	return err
@@ -134,15 +367,19 @@ func (f *FileWriter) Finish() error {
 	if f.Status == PAUSED {
 		return errors.New("File Writing is paused")
 	}
-	f.DataFile.Close()
+	for _, df := range f.DataFiles {
+		df.File.Close()
+	}
 	f = nil
 	return nil
 }
 
 func (f *FileWriter) Sync() error {
 
-	if err := f.DataFile.Sync(); err != nil {
-		return err
+	for _, df := range f.DataFiles {
+		if err := df.File.Sync(); err != nil {
+			return err
+		}
 	}
 	return nil
 
@@ -151,7 +388,7 @@ func (f *FileWriter) Sync() error {
 // Pause momentarily stops writing to the file - does not write until restarted
 // and writes buffer to disc
 func (f *FileWriter) Pause() error {
-	if err := f.DataFile.Sync(); err != nil {
+	if err := f.Sync(); err != nil {
 		return err
 	}
 	f.Status = PAUSED
@@ -166,16 +403,3 @@ func (f *FileWriter) Restart() bool {
 	}
 	return false
 }
-
-// Write meta data to meta file
-func (f *FileWriter) WriteMetaData(data []byte) error {
-	_, err := f.MetaDataFile.WriteAt(data, 0)
-	return err
-}
-
-func (f *FileWriter) GetMetaData(size int) ([]byte, error) {
-	data := make([]byte, size, size)
-	_, err := f.MetaDataFile.ReadAt(data, 0)
-	//fmt.Println(data)
-	return data, err
-}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+* HELPER
+* lays the torrent's bytes out over three files, the middle one empty, opened for reading and writing
+* @data: bytes of the whole torrent
+* returns: the FileWriter over the files, the directory they are in
+ */
+func spanningFiles(t *testing.T, data []byte) (FileWriter, string) {
+	dir := t.TempDir()
+	fw := FileWriter{Info: &InfoDict{Name: "files", PieceLength: 4}}
+	split := 5
+	var offset int64
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{"a.bin", data[:split]}, {"empty.bin", nil}, {"c.bin", data[split:]}} {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, file.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.DataFiles = append(fw.DataFiles, DataFile{Path: path, Offset: offset, Length: int64(len(file.data)), File: f})
+		offset += int64(len(file.data))
+	}
+	return fw, dir
+}
+
+func TestSpanFiles(t *testing.T) {
+	data := []byte("0123456789ab") //pieces of 4 bytes: the second one spans a.bin, empty.bin and c.bin
+	fw, _ := spanningFiles(t, data)
+	defer fw.Finish()
+
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int
+		wantErr bool
+	}{
+		{name: "inside the first file", offset: 0, length: 4},
+		{name: "across the empty file", offset: 4, length: 4},
+		{name: "ending on the first file's end", offset: 2, length: 3},
+		{name: "starting on the last file's start", offset: 5, length: 7},
+		{name: "the whole torrent", offset: 0, length: len(data)},
+		{name: "past the end", offset: 8, length: 5, wantErr: true},
+		{name: "after the end", offset: int64(len(data)), length: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, tt.length)
+			n, err := fw.ReadAt(buf, tt.offset)
+			if tt.wantErr {
+				if err != io.ErrUnexpectedEOF {
+					t.Fatalf("read %d bytes past the end, err %v", n, err)
+				}
+				return
+			}
+			if err != nil || n != tt.length {
+				t.Fatalf("read %d bytes, %v", n, err)
+			}
+			if !bytes.Equal(buf, data[tt.offset:tt.offset+int64(tt.length)]) {
+				t.Fatalf("read %q, want %q", buf, data[tt.offset:tt.offset+int64(tt.length)])
+			}
+		})
+	}
+}
+
+func TestSpanFilesWrite(t *testing.T) {
+	fw, dir := spanningFiles(t, make([]byte, 12))
+	defer fw.Finish()
+
+	if n, err := fw.WriteAt([]byte("WXYZ"), 3); err != nil || n != 4 {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+	for name, want := range map[string]string{"a.bin": "\x00\x00\x00WX", "empty.bin": "", "c.bin": "YZ\x00\x00\x00\x00\x00"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s holds %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOpenFileWriterRejectsBadPaths(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		path []string
+	}{
+		{name: "empty path", path: nil},
+		{name: "parent directory", path: []string{"..", "a.bin"}},
+		{name: "empty element", path: []string{"", "a.bin"}},
+		{name: "missing file", path: []string{"b.bin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iDict := &InfoDict{Name: "files", PieceLength: 4, Pieces: strings.Repeat("x", 20), Files: []InfoFile{{Length: 4, Path: tt.path}}}
+			if fw, err := OpenFileWriter(iDict, dir); err == nil {
+				fw.Finish()
+				t.Fatal("bad path opened")
+			}
+		})
+	}
+}
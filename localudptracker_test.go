@@ -0,0 +1,214 @@
+package main
+
+/*
+* minimal UDP tracker (BEP 15) on the loopback interface
+* stands in for a real tracker when testing the UDP transport or a local swarm
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// LocalUDPTracker answers connect, announce and scrape requests and remembers who announced
+type LocalUDPTracker struct {
+	conn     *net.UDPConn
+	Interval int32 // interval handed out in announce responses
+
+	// DropPackets makes the tracker ignore that many incoming requests, to exercise retransmission
+	DropPackets int
+	// StaleReplies makes the tracker answer that many requests with a wrong transaction id first
+	StaleReplies int
+	// Requests counts the requests received, dropped ones included
+	Requests int
+	// Connects counts the connect requests answered
+	Connects int
+
+	connectionIDs map[int64]bool
+	swarms        map[string]map[string]localSwarmPeer // info hash -> ip:port -> peer
+	lock          *sync.Mutex
+}
+
+// localSwarmPeer is an announced peer and whether it has finished downloading
+type localSwarmPeer struct {
+	addr     net.UDPAddr
+	complete bool
+}
+
+/*
+* starts a local tracker on a free loopback port
+* returns: the tracker, error
+ */
+func NewLocalUDPTracker() (*LocalUDPTracker, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	t := &LocalUDPTracker{
+		conn:          conn,
+		Interval:      1800,
+		connectionIDs: make(map[int64]bool),
+		swarms:        make(map[string]map[string]localSwarmPeer),
+		lock:          &sync.Mutex{},
+	}
+	go t.serve()
+	return t, nil
+}
+
+// URL is the announce URL of the tracker
+func (t *LocalUDPTracker) URL() string {
+	return "udp://" + t.conn.LocalAddr().String() + "/announce"
+}
+
+// Close stops the tracker
+func (t *LocalUDPTracker) Close() error {
+	return t.conn.Close()
+}
+
+/*
+* HELPER
+* answers requests until the socket is closed
+ */
+func (t *LocalUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		t.lock.Lock()
+		t.Requests++
+		drop := t.DropPackets > 0
+		if drop {
+			t.DropPackets--
+		}
+		stale := !drop && t.StaleReplies > 0
+		if stale {
+			t.StaleReplies--
+		}
+		t.lock.Unlock()
+		if drop || n < 16 {
+			continue
+		}
+		reply := t.handle(buf[:n], addr)
+		if reply == nil {
+			continue
+		}
+		if stale {
+			old := append([]byte(nil), reply...)
+			binary.BigEndian.PutUint32(old[4:8], binary.BigEndian.Uint32(old[4:8])+1)
+			t.conn.WriteToUDP(old, addr)
+		}
+		t.conn.WriteToUDP(reply, addr)
+	}
+}
+
+/*
+* HELPER
+* builds the response to a single request
+* returns: the response datagram, nil to stay silent
+ */
+func (t *LocalUDPTracker) handle(req []byte, addr *net.UDPAddr) []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	connectionID := int64(binary.BigEndian.Uint64(req[0:8]))
+	action := int32(binary.BigEndian.Uint32(req[8:12]))
+	transactionID := int32(binary.BigEndian.Uint32(req[12:16]))
+
+	reply := new(bytes.Buffer)
+	binary.Write(reply, binary.BigEndian, action)
+	binary.Write(reply, binary.BigEndian, transactionID)
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		id := rand.Int63()
+		t.connectionIDs[id] = true
+		t.Connects++
+		binary.Write(reply, binary.BigEndian, id)
+		return reply.Bytes()
+	}
+
+	if !t.connectionIDs[connectionID] {
+		return localTrackerError(transactionID, "unknown connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		if len(req) < 98 {
+			return localTrackerError(transactionID, "announce too short")
+		}
+		infoHash := string(req[16:36])
+		left := binary.BigEndian.Uint64(req[64:72])
+		event := binary.BigEndian.Uint32(req[80:84])
+		port := binary.BigEndian.Uint16(req[96:98])
+
+		swarm, ok := t.swarms[infoHash]
+		if !ok {
+			swarm = make(map[string]localSwarmPeer)
+			t.swarms[infoHash] = swarm
+		}
+		self := net.UDPAddr{IP: addr.IP, Port: int(port)}
+
+		seeders, leechers := int32(0), int32(0)
+		peers := new(bytes.Buffer)
+		for key, p := range swarm {
+			if key == self.String() {
+				continue
+			}
+			if p.complete {
+				seeders++
+			} else {
+				leechers++
+			}
+			peers.Write(p.addr.IP.To4())
+			binary.Write(peers, binary.BigEndian, uint16(p.addr.Port))
+		}
+
+		if event == 3 { // stopped
+			delete(swarm, self.String())
+		} else {
+			swarm[self.String()] = localSwarmPeer{addr: self, complete: left == 0}
+		}
+
+		binary.Write(reply, binary.BigEndian, t.Interval)
+		binary.Write(reply, binary.BigEndian, leechers)
+		binary.Write(reply, binary.BigEndian, seeders)
+		reply.Write(peers.Bytes())
+		return reply.Bytes()
+
+	case udpActionScrape:
+		for i := 16; i+20 <= len(req); i += 20 {
+			seeders, leechers := int32(0), int32(0)
+			for _, p := range t.swarms[string(req[i:i+20])] {
+				if p.complete {
+					seeders++
+				} else {
+					leechers++
+				}
+			}
+			binary.Write(reply, binary.BigEndian, seeders)
+			binary.Write(reply, binary.BigEndian, seeders) // completed, approximated by current seeders
+			binary.Write(reply, binary.BigEndian, leechers)
+		}
+		return reply.Bytes()
+	}
+	return localTrackerError(transactionID, "unknown action")
+}
+
+/*
+* HELPER
+* builds an error response
+ */
+func localTrackerError(transactionID int32, message string) []byte {
+	reply := new(bytes.Buffer)
+	binary.Write(reply, binary.BigEndian, udpActionError)
+	binary.Write(reply, binary.BigEndian, transactionID)
+	reply.WriteString(message)
+	return reply.Bytes()
+}
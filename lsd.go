@@ -0,0 +1,265 @@
+package main
+
+/*
+* local service discovery (BEP 14), finds peers on the local network without a tracker
+* every torrent's info hash is announced in a BT-SEARCH message to a multicast group,
+* peers on the LAN announcing the same hash become candidate peers
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsdGroup         = "239.192.152.143:6771"
+	lsdInterval      = 5 * time.Minute // time between two announces of the same torrent
+	lsdMinInterval   = time.Minute     // announces of a torrent from the same host faster than this are ignored
+	lsdHashesPerSend = 20              // info hashes in a single announce, keeps it well inside one packet
+)
+
+// LSD announces our torrents on the local network and hands the peers it hears about to their torrent
+type LSD struct {
+	port   int            // TCP port we accept peers on
+	conn   net.PacketConn // sends to and receives from the group
+	group  net.Addr       // where announces go
+	cookie string         // sent with our announces so we recognize them when they loop back
+
+	torrents map[string]func([]Peer) // hex info hash -> receives the peers found for it
+	heard    map[string]time.Time    // "ip hash" -> when that host last announced that hash
+
+	lock *sync.Mutex
+	done chan bool
+}
+
+/*
+* joins the LSD multicast group
+* @port: TCP port we accept peers on, announced to the LAN
+* returns: the LSD, error if the group cannot be joined
+ */
+func NewLSD(port int) (*LSD, error) {
+	group, err := net.ResolveUDPAddr("udp4", lsdGroup)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	return newLSD(port, conn, group), nil
+}
+
+/*
+* HELPER
+* creates an LSD on any packet transport, NewLSD uses multicast UDP, tests can use plain sockets
+* @port: TCP port we accept peers on
+* @conn: the transport
+* @group: the address announces are sent to
+* returns: the LSD
+ */
+func newLSD(port int, conn net.PacketConn, group net.Addr) *LSD {
+	l := &LSD{
+		port:     port,
+		conn:     conn,
+		group:    group,
+		cookie:   hex.EncodeToString(randomBytes(8)),
+		torrents: make(map[string]func([]Peer)),
+		heard:    make(map[string]time.Time),
+		lock:     &sync.Mutex{},
+		done:     make(chan bool),
+	}
+	go l.serve()
+	go l.announceLoop()
+	return l
+}
+
+/*
+* announces a torrent from now on, right away and then every lsdInterval
+* @infoHash: the torrent's info hash
+* @pool: called with the LAN peers announcing the torrent, e.g. PeerContactManager.AddPeers
+ */
+func (l *LSD) Add(infoHash string, pool func([]Peer)) {
+	hash := hex.EncodeToString([]byte(infoHash))
+	l.lock.Lock()
+	l.torrents[hash] = pool
+	l.lock.Unlock()
+	if err := l.announce([]string{hash}); err != nil {
+		fmt.Println("LSD:", err)
+	}
+}
+
+/*
+* stops announcing a torrent and ignores its peers
+* @infoHash: the torrent's info hash
+ */
+func (l *LSD) Remove(infoHash string) {
+	l.lock.Lock()
+	delete(l.torrents, hex.EncodeToString([]byte(infoHash)))
+	l.lock.Unlock()
+}
+
+/*
+* leaves the group and stops announcing
+* returns: error
+ */
+func (l *LSD) Close() error {
+	close(l.done)
+	return l.conn.Close()
+}
+
+/*
+* HELPER
+* announces every torrent each lsdInterval, and forgets hosts not heard from since
+ */
+func (l *LSD) announceLoop() {
+	ticker := time.NewTicker(lsdInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		l.lock.Lock()
+		hashes := make([]string, 0, len(l.torrents))
+		for hash := range l.torrents {
+			hashes = append(hashes, hash)
+		}
+		for key, last := range l.heard {
+			if time.Since(last) > lsdMinInterval {
+				delete(l.heard, key)
+			}
+		}
+		l.lock.Unlock()
+
+		for len(hashes) > 0 {
+			n := len(hashes)
+			if n > lsdHashesPerSend {
+				n = lsdHashesPerSend
+			}
+			if err := l.announce(hashes[:n]); err != nil {
+				fmt.Println("LSD:", err)
+			}
+			hashes = hashes[n:]
+		}
+	}
+}
+
+/*
+* HELPER
+* sends a BT-SEARCH message to the group
+* @hashes: hex info hashes to announce
+* returns: error
+ */
+func (l *LSD) announce(hashes []string) error {
+	msg := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: " + lsdGroup + "\r\n" +
+		"Port: " + strconv.Itoa(l.port) + "\r\n"
+	for _, hash := range hashes {
+		msg += "Infohash: " + hash + "\r\n"
+	}
+	msg += "cookie: " + l.cookie + "\r\n\r\n\r\n"
+	_, err := l.conn.WriteTo([]byte(msg), l.group)
+	return err
+}
+
+/*
+* HELPER
+* reads announces until Close, handing the sender to every torrent it announced that we run
+ */
+func (l *LSD) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		port, hashes, cookie, err := parseLSDAnnounce(buf[:n])
+		if err != nil || cookie == l.cookie {
+			continue
+		}
+
+		peer := Peer{IP: udpAddr.IP.String(), Port: int64(port)}
+		now := time.Now()
+		for _, hash := range hashes {
+			key := peer.IP + " " + hash
+			l.lock.Lock()
+			pool, ok := l.torrents[hash]
+			if last, seen := l.heard[key]; ok && seen && now.Sub(last) < lsdMinInterval {
+				ok = false
+			}
+			if ok {
+				l.heard[key] = now
+			}
+			l.lock.Unlock()
+			if ok {
+				fmt.Printf("LSD: %s has %s\n", peer.Addr(), hash)
+				pool([]Peer{peer})
+			}
+		}
+	}
+}
+
+/*
+* HELPER
+* parses a BT-SEARCH message
+* @data: the datagram
+* returns: the port the sender accepts peers on, its lower case hex info hashes, its cookie, error if it is not an announce
+ */
+func parseLSDAnnounce(data []byte) (int, []string, string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", errors.New("parseLSDAnnounce: not a BT-SEARCH message")
+	}
+
+	port := 0
+	var hashes []string
+	cookie := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(line[:colon]) {
+		case "port":
+			p, err := strconv.Atoi(value)
+			if err != nil || p <= 0 || p > 65535 {
+				return 0, nil, "", errors.New("parseLSDAnnounce: bad port")
+			}
+			port = p
+		case "infohash":
+			if len(value) == 40 {
+				hashes = append(hashes, strings.ToLower(value))
+			}
+		case "cookie":
+			cookie = value
+		}
+	}
+	if port == 0 || len(hashes) == 0 {
+		return 0, nil, "", errors.New("parseLSDAnnounce: no port or info hash")
+	}
+	return port, hashes, cookie, nil
+}
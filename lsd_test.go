@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLSDAnnounce(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name       string
+		data       string
+		wantErr    bool
+		wantPort   int
+		wantHashes []string
+		wantCookie string
+	}{
+		{
+			name:       "announce",
+			data:       "BT-SEARCH * HTTP/1.1\r\nHost: " + lsdGroup + "\r\nPort: 6881\r\nInfohash: " + hash + "\r\ncookie: abc\r\n\r\n\r\n",
+			wantPort:   6881,
+			wantHashes: []string{hash},
+			wantCookie: "abc",
+		},
+		{
+			name:       "several hashes, upper case and bare newlines",
+			data:       "BT-SEARCH * HTTP/1.1\nport: 12\ninfohash: " + strings.ToUpper(hash) + "\nInfohash: " + hash + "\n\n",
+			wantPort:   12,
+			wantHashes: []string{hash, hash},
+		},
+		{
+			name:       "short hashes are skipped",
+			data:       "BT-SEARCH * HTTP/1.1\r\nPort: 12\r\nInfohash: 00\r\nInfohash: " + hash + "\r\n\r\n",
+			wantPort:   12,
+			wantHashes: []string{hash},
+		},
+		{name: "not a search", data: "GET / HTTP/1.1\r\nPort: 12\r\nInfohash: " + hash + "\r\n\r\n", wantErr: true},
+		{name: "empty", data: "", wantErr: true},
+		{name: "no port", data: "BT-SEARCH * HTTP/1.1\r\nInfohash: " + hash + "\r\n\r\n", wantErr: true},
+		{name: "bad port", data: "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + hash + "\r\n\r\n", wantErr: true},
+		{name: "no info hash", data: "BT-SEARCH * HTTP/1.1\r\nPort: 12\r\nInfohash: 00\r\n\r\n", wantErr: true},
+		{name: "headers after the blank line", data: "BT-SEARCH * HTTP/1.1\r\n\r\nPort: 12\r\nInfohash: " + hash + "\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, hashes, cookie, err := parseLSDAnnounce([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("malformed announce parsed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tt.wantPort || cookie != tt.wantCookie || strings.Join(hashes, ",") != strings.Join(tt.wantHashes, ",") {
+				t.Fatalf("got %d %v %q, want %d %v %q", port, hashes, cookie, tt.wantPort, tt.wantHashes, tt.wantCookie)
+			}
+		})
+	}
+}
+
+/*
+* HELPER
+* a loopback socket standing in for the multicast group
+ */
+func loopbackPacketConn(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+/*
+* HELPER
+* waits for the peers an LSD handed a torrent
+* returns: the peers, nil if none came within wait
+ */
+func receivePeers(ch chan []Peer, wait time.Duration) []Peer {
+	select {
+	case peers := <-ch:
+		return peers
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func TestLSDDiscovery(t *testing.T) {
+	ca, cb := loopbackPacketConn(t), loopbackPacketConn(t)
+	// each one's group is the other's socket
+	a := newLSD(7000, ca, cb.LocalAddr())
+	b := newLSD(7001, cb, ca.LocalAddr())
+	defer a.Close()
+	defer b.Close()
+
+	hash := "abcdefghijabcdefghij"
+	fromA, fromB := make(chan []Peer, 10), make(chan []Peer, 10)
+	a.Add(hash, func(peers []Peer) { fromB <- peers })
+	b.Add(hash, func(peers []Peer) { fromA <- peers })
+
+	peers := receivePeers(fromB, time.Second)
+	if len(peers) != 1 || peers[0].IP != "127.0.0.1" || peers[0].Port != 7001 {
+		t.Fatalf("a heard %v, want 127.0.0.1:7001", peers)
+	}
+	// a announced before b ran the torrent, b learns about a from its next announce
+	a.Add(hash, func(peers []Peer) { fromB <- peers })
+	peers = receivePeers(fromA, time.Second)
+	if len(peers) != 1 || peers[0].IP != "127.0.0.1" || peers[0].Port != 7000 {
+		t.Fatalf("b heard %v, want 127.0.0.1:7000", peers)
+	}
+
+	// torrents the receiver does not run are ignored
+	a.Add("zzzzzzzzzzzzzzzzzzzz", func(peers []Peer) {})
+	if peers := receivePeers(fromA, 200*time.Millisecond); peers != nil {
+		t.Fatalf("b took %v for a torrent it does not run", peers)
+	}
+}
+
+func TestLSDIgnoresOwnAnnounces(t *testing.T) {
+	conn := loopbackPacketConn(t)
+	// announces loop back to the sender, as they do on a multicast group
+	l := newLSD(7000, conn, conn.LocalAddr())
+	defer l.Close()
+
+	got := make(chan []Peer, 10)
+	l.Add("abcdefghijabcdefghij", func(peers []Peer) { got <- peers })
+	if peers := receivePeers(got, 200*time.Millisecond); peers != nil {
+		t.Fatalf("took our own announce: %v", peers)
+	}
+}
+
+func TestLSDFloodGuard(t *testing.T) {
+	ca, cb := loopbackPacketConn(t), loopbackPacketConn(t)
+	a := newLSD(7000, ca, cb.LocalAddr())
+	b := newLSD(7001, cb, ca.LocalAddr())
+	defer a.Close()
+	defer b.Close()
+
+	hash := "abcdefghijabcdefghij"
+	got := make(chan []Peer, 10)
+	b.Add(hash, func(peers []Peer) { got <- peers })
+	a.Add(hash, func(peers []Peer) {})
+	if peers := receivePeers(got, time.Second); peers == nil {
+		t.Fatal("first announce not heard")
+	}
+
+	// a second announce inside lsdMinInterval is dropped
+	a.Add(hash, func(peers []Peer) {})
+	if peers := receivePeers(got, 200*time.Millisecond); peers != nil {
+		t.Fatalf("repeated announce taken: %v", peers)
+	}
+
+	// once lsdMinInterval passed the host is heard again
+	b.lock.Lock()
+	for key := range b.heard {
+		b.heard[key] = time.Now().Add(-lsdMinInterval)
+	}
+	b.lock.Unlock()
+	a.Add(hash, func(peers []Peer) {})
+	if peers := receivePeers(got, time.Second); peers == nil {
+		t.Fatal("announce after lsdMinInterval not heard")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Magnet is the decoded content of a magnet URI
+type Magnet struct {
+	InfoHash    []byte   // 20 byte info hash from xt=urn:btih:
+	DisplayName string   // dn, only used until the info dictionary arrives
+	Trackers    []string // tr, in the order they appear in the link
+}
+
+//ParseMagnet decodes a magnet:?xt=urn:btih:... URI
+//the info hash may be given as 40 hex characters or 32 base32 characters
+func ParseMagnet(uri string) (m Magnet, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "magnet" {
+		err = errors.New("ParseMagnet: not a magnet URI")
+		return
+	}
+
+	query := u.Query()
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		if m.InfoHash, err = decodeInfoHash(strings.TrimPrefix(xt, "urn:btih:")); err != nil {
+			return
+		}
+		break
+	}
+	if m.InfoHash == nil {
+		err = errors.New("ParseMagnet: missing urn:btih info hash")
+		return
+	}
+
+	m.DisplayName = query.Get("dn")
+	m.Trackers = query["tr"]
+	return
+}
+
+/*
+* HELPER
+* decodes the hex or base32 form of an info hash
+* returns: the 20 byte hash, error
+ */
+func decodeInfoHash(s string) ([]byte, error) {
+	var hash []byte
+	var err error
+	switch len(s) {
+	case 40:
+		hash, err = hex.DecodeString(s)
+	case 32:
+		hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return nil, errors.New("decodeInfoHash: info hash has invalid length")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+//Torrent returns a torrent with the magnet's trackers but no info dictionary
+//each tracker goes in its own tier, as the link gives no grouping
+func (m Magnet) Torrent() *Torrent {
+	var t Torrent
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+	}
+	for _, tr := range m.Trackers {
+		t.AnnounceList = append(t.AnnounceList, []string{tr})
+	}
+	return &t
+}
@@ -32,8 +32,13 @@ const (
 	PIECE MsgType = iota
 	// CANCEL is a message type
 	CANCEL MsgType = iota
+	// PORT is a message type, the peer's DHT port (BEP 5)
+	PORT MsgType = iota
 )
 
+// EXTENDED is the extension protocol message type (BEP 10), wire id 20
+const EXTENDED MsgType = 21
+
 // Payload struct containing payload information in a message
 type Payload struct {
 	pieceIndex int32
@@ -41,6 +46,8 @@ type Payload struct {
 	begin      int32
 	length     int32
 	block      []byte
+	extendedID byte   // extension message id, 0 is the extended handshake
+	port       uint16 // DHT port of a PORT message
 } // last part of the message. contains message content
 
 // NewPayload creates a payload from byte array
@@ -61,7 +68,9 @@ func NewPayload(m MsgType, payloadBytes []byte) Payload {
 		reader := bytes.NewReader(payloadBytes)
 		binary.Read(reader, binary.BigEndian, &p.pieceIndex)
 		binary.Read(reader, binary.BigEndian, &p.begin)
-		p.block = payloadBytes[8:]
+		if len(payloadBytes) >= 8 {
+			p.block = payloadBytes[8:]
+		}
 		//binary.Read(reader, binary.BigEndian, &p.block)
 
 	case REQUEST: //requests a piece
@@ -71,6 +80,13 @@ func NewPayload(m MsgType, payloadBytes []byte) Payload {
 		binary.Read(reader, binary.BigEndian, &p.pieceIndex)
 		binary.Read(reader, binary.BigEndian, &p.begin)
 		binary.Read(reader, binary.BigEndian, &p.length)
+	case PORT: // the UDP port the peer's DHT node listens on
+		binary.Read(bytes.NewReader(payloadBytes), binary.BigEndian, &p.port)
+	case EXTENDED: // extension id followed by the extension's own payload
+		if len(payloadBytes) > 0 {
+			p.extendedID = payloadBytes[0]
+			p.block = payloadBytes[1:]
+		}
 	}
 
 	return p
@@ -85,10 +101,15 @@ type Message struct {
 }
 
 // NewMessage parses byte array to create a message struct
+// messages whose payload does not have the length their type needs are an error
 func NewMessage(msgBytes []byte) (Message, error) {
 	var msg Message
 
-	switch msg.Mtype = getType(msgBytes); msg.Mtype {
+	msg.Mtype = getType(msgBytes)
+	if !validPayloadLength(msg.Mtype, len(msgBytes)-5) {
+		return Message{}, errors.New("NewMessage: wrong payload length")
+	}
+	switch msg.Mtype {
 	case KEEPALIVE:
 	case CHOKE:
 		fallthrough
@@ -106,8 +127,13 @@ func NewMessage(msgBytes []byte) (Message, error) {
 	case CANCEL:
 		msg.Length = 13
 		msg.Payload = NewPayload(msg.Mtype, msgBytes[5:])
+	case PORT:
+		msg.Length = 3
+		msg.Payload = NewPayload(msg.Mtype, msgBytes[5:])
 	case BITFIELD:
 		fallthrough
+	case EXTENDED:
+		fallthrough
 	case PIECE:
 
 		msg.Length = len(msgBytes) - 4
@@ -119,6 +145,29 @@ func NewMessage(msgBytes []byte) (Message, error) {
 	return msg, nil
 }
 
+/*
+* HELPER
+* checks the payload of a message is long enough to be parsed
+* @m: the message type
+* @length: payload length, the bytes after the id
+* returns: false if NewPayload could not parse it
+ */
+func validPayloadLength(m MsgType, length int) bool {
+	switch m {
+	case HAVE:
+		return length == 4
+	case REQUEST, CANCEL:
+		return length == 12
+	case PORT:
+		return length == 2
+	case PIECE:
+		return length >= 8
+	case EXTENDED:
+		return length >= 1
+	}
+	return true
+}
+
 func getType(msgBytes []byte) MsgType {
 
 	if len(msgBytes) <= 4 {
@@ -182,6 +231,23 @@ func CreateMessage(msgType MsgType, payLoad Payload) (arr []byte, err error) {
 		binary.Write(buf, binary.BigEndian, id)
 		binary.Write(buf, binary.BigEndian, payLoad.bitField)
 		arr = buf.Bytes()
+	case PORT:
+		buf := new(bytes.Buffer)
+		var length int32 = 3
+		var id byte = 9
+		binary.Write(buf, binary.BigEndian, length)
+		binary.Write(buf, binary.BigEndian, id)
+		binary.Write(buf, binary.BigEndian, payLoad.port)
+		arr = buf.Bytes()
+	case EXTENDED:
+		buf := new(bytes.Buffer)
+		var length = 2 + int32(len(payLoad.block))
+		var id byte = 20
+		binary.Write(buf, binary.BigEndian, length)
+		binary.Write(buf, binary.BigEndian, id)
+		binary.Write(buf, binary.BigEndian, payLoad.extendedID)
+		binary.Write(buf, binary.BigEndian, payLoad.block)
+		arr = buf.Bytes()
 	default:
 		return nil, errors.New("NewMessage: Unknown message type")
 	}
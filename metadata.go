@@ -0,0 +1,366 @@
+package main
+
+/*
+* ut_metadata (BEP 9)
+* fetches the info dictionary of a magnet link from peers, and serves ours to peers that ask
+* the fetch runs before the piece pipeline exists, so it speaks to peers on its own connection
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	metadataPieceSize = 16384   // ut_metadata sends the info dictionary in 16KiB pieces
+	maxMetadataSize   = 8 << 20 // refuse to buffer anything bigger than this
+	bencodeMaxDepth   = 32      // lists and dictionaries nested deeper than this in a message header are refused
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+//metadataMessage is the bencoded header of a ut_metadata message
+type metadataMessage struct {
+	MsgType   int64 `bencode:"msg_type"`
+	Piece     int64 `bencode:"piece"`
+	TotalSize int64 `bencode:"total_size,omitempty"`
+}
+
+/*
+* asks each peer in turn for the info dictionary until one delivers a copy matching the hash
+* @m: the parsed magnet link
+* @peers: peers to ask
+* @timeout: seconds to wait on a single peer read
+* @encryption: whether the connections are encrypted, see EncryptionMode
+* returns: a torrent with the info dictionary filled in, error
+ */
+func FetchMetadata(m Magnet, peers []Peer, timeout int, encryption EncryptionMode) (*Torrent, error) {
+	info := TorrentInfo{
+		ClientID:     ClientID,
+		ProtoName:    ProtoName,
+		ProtoNameLen: len(ProtoName),
+		InfoHash:     string(m.InfoHash),
+	}
+
+	for _, peer := range peers {
+		addr := peer.Addr()
+		conn, err := DialPeer(addr, info.InfoHash, encryption, time.Duration(timeout)*time.Second)
+		if err != nil {
+			fmt.Printf("metadata: could not connect to %s: %v\n", addr, err)
+			continue
+		}
+		metadata, err := fetchMetadataFromPeer(conn, peer, info, timeout)
+		conn.Close()
+		if err != nil {
+			fmt.Printf("metadata: %s: %v\n", addr, err)
+			continue
+		}
+
+		torrent := m.Torrent()
+		torrent.Info = bencode.RawMessage(metadata)
+		return torrent, nil
+	}
+	return nil, errors.New("FetchMetadata: no peer returned the info dictionary")
+}
+
+/*
+* HELPER
+* runs the handshake, extended handshake and ut_metadata exchange on a single connection
+* returns: the verified info dictionary bytes, error
+ */
+func fetchMetadataFromPeer(conn net.Conn, peer Peer, info TorrentInfo, timeout int) ([]byte, error) {
+	var pkt Packet
+	pWriter := bufio.NewWriter(conn)
+	pReader := bufio.NewReader(conn)
+
+	if err := pkt.SendHandshakePacket(pWriter, info); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	hs, err := pkt.ReceiveHandshakePacket(pReader, peer, info)
+	if err != nil {
+		return nil, err
+	}
+	if !hs.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	// only ut_metadata is registered while fetching
+	registry := NewExtensionRegistry()
+	localID := registry.Register(NewMetadataExtension(nil))
+	handshake, err := registry.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	if err := sendExtendedMessage(pWriter, 0, handshake); err != nil {
+		return nil, err
+	}
+
+	// wait for the peer's extended handshake, skipping bitfields and haves
+	var remote ExtendedHandshake
+	for {
+		extID, payload, err := readExtendedMessage(pReader, conn, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if extID != 0 {
+			continue
+		}
+		if err := bencode.DecodeBytes(payload, &remote); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	remoteID, ok := remote.M["ut_metadata"]
+	if !ok || remoteID == 0 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+	if remote.MetadataSize <= 0 || remote.MetadataSize > maxMetadataSize {
+		return nil, errors.New("peer sent an invalid metadata_size")
+	}
+
+	metadata := make([]byte, remote.MetadataSize)
+	numPieces := (len(metadata) + metadataPieceSize - 1) / metadataPieceSize
+	for piece := 0; piece < numPieces; piece++ {
+		req, err := bencode.EncodeBytes(metadataMessage{MsgType: metadataRequest, Piece: int64(piece)})
+		if err != nil {
+			return nil, err
+		}
+		if err := sendExtendedMessage(pWriter, byte(remoteID), req); err != nil {
+			return nil, err
+		}
+
+		for {
+			extID, payload, err := readExtendedMessage(pReader, conn, timeout)
+			if err != nil {
+				return nil, err
+			}
+			if extID != localID {
+				continue
+			}
+			msg, data, err := parseMetadataMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+			if msg.MsgType == metadataReject {
+				return nil, errors.New("peer rejected metadata request")
+			}
+			if msg.MsgType != metadataData || msg.Piece != int64(piece) {
+				continue
+			}
+
+			begin := piece * metadataPieceSize
+			end := begin + metadataPieceSize
+			if end > len(metadata) {
+				end = len(metadata)
+			}
+			if len(data) != end-begin {
+				return nil, errors.New("metadata piece has the wrong size")
+			}
+			copy(metadata[begin:end], data)
+			break
+		}
+	}
+
+	if hash := sha1.Sum(metadata); string(hash[:]) != info.InfoHash {
+		return nil, errors.New("metadata does not match info hash")
+	}
+	return metadata, nil
+}
+
+/*
+* HELPER
+* writes an extension protocol message straight to the connection
+* @extID: the extension id the receiver assigned, 0 for the handshake
+* @payload: the extension's payload
+* returns: error
+ */
+func sendExtendedMessage(pWriter *bufio.Writer, extID byte, payload []byte) error {
+	msg, err := CreateMessage(EXTENDED, Payload{extendedID: extID, block: payload})
+	if err != nil {
+		return err
+	}
+	return bufferWrite(pWriter, msg)
+}
+
+/*
+* HELPER
+* reads length prefixed messages until an extension protocol message arrives
+* other messages are skipped without parsing, the peer may send ids NewMessage does not know
+* returns: the extension id, the payload after it, error
+ */
+func readExtendedMessage(pReader *bufio.Reader, conn net.Conn, timeout int) (byte, []byte, error) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		prefix, err := readPacket(4, pReader)
+		if err != nil {
+			return 0, nil, err
+		}
+		length := binary.BigEndian.Uint32(prefix)
+		if length == 0 { // keep alive
+			continue
+		}
+		if length > maxMessageLength {
+			return 0, nil, errors.New("message too large")
+		}
+		data, err := readPacket(int(length), pReader)
+		if err != nil {
+			return 0, nil, err
+		}
+		if MsgType(int(data[0])+1) != EXTENDED || len(data) < 2 {
+			continue
+		}
+		return data[1], data[2:], nil
+	}
+}
+
+/*
+* HELPER
+* splits a ut_metadata payload into its bencoded header and the piece data that follows it
+* returns: header, piece data, error
+ */
+func parseMetadataMessage(payload []byte) (metadataMessage, []byte, error) {
+	var msg metadataMessage
+	n, err := bencodeLength(payload)
+	if err != nil {
+		return msg, nil, err
+	}
+	if err := bencode.DecodeBytes(payload[:n], &msg); err != nil {
+		return msg, nil, err
+	}
+	return msg, payload[n:], nil
+}
+
+/*
+* HELPER
+* finds where the first bencoded value in b ends
+* returns: length of the value in bytes, error
+ */
+func bencodeLength(b []byte) (int, error) {
+	return bencodeValueLength(b, 0)
+}
+
+/*
+* HELPER
+* bencodeLength of a value nested in depth lists or dictionaries, deeper nesting than bencodeMaxDepth is refused
+* returns: length of the value in bytes, error
+ */
+func bencodeValueLength(b []byte, depth int) (int, error) {
+	if len(b) == 0 {
+		return 0, errors.New("bencodeLength: empty input")
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return 0, errors.New("bencodeLength: unterminated integer")
+		}
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		if depth >= bencodeMaxDepth {
+			return 0, errors.New("bencodeLength: nested too deep")
+		}
+		pos := 1
+		for pos < len(b) && b[pos] != 'e' {
+			n, err := bencodeValueLength(b[pos:], depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos += n
+		}
+		if pos >= len(b) {
+			return 0, errors.New("bencodeLength: unterminated list")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return 0, errors.New("bencodeLength: malformed string")
+		}
+		//compare before adding, a huge size would overflow the sum
+		size, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || size < 0 || size > len(b)-colon-1 {
+			return 0, errors.New("bencodeLength: malformed string")
+		}
+		return colon + 1 + size, nil
+	}
+	return 0, errors.New("bencodeLength: invalid bencode")
+}
+
+// MetadataExtension serves our info dictionary to peers over ut_metadata
+type MetadataExtension struct {
+	metadata []byte // bencoded info dictionary, nil while we are still fetching it
+}
+
+/*
+* create the ut_metadata extension
+* @metadata: the bencoded info dictionary to serve, nil if we do not have it
+* returns: the extension
+ */
+func NewMetadataExtension(metadata []byte) *MetadataExtension {
+	return &MetadataExtension{metadata: metadata}
+}
+
+// Name is the ut_metadata extension name
+func (e *MetadataExtension) Name() string {
+	return "ut_metadata"
+}
+
+// ExtendHandshake advertises the size of the info dictionary
+func (e *MetadataExtension) ExtendHandshake(hs *ExtendedHandshake) {
+	if len(e.metadata) > 0 {
+		hs.MetadataSize = int64(len(e.metadata))
+	}
+}
+
+/*
+* answers metadata requests with the matching piece, or a reject if we do not have it
+* @t: connection the request came in on
+* @payload: the ut_metadata message
+* returns: error
+ */
+func (e *MetadataExtension) HandleMessage(t *ConnectionManager, payload []byte) error {
+	msg, _, err := parseMetadataMessage(payload)
+	if err != nil {
+		return err
+	}
+	if msg.MsgType != metadataRequest { // we never ask connected peers for metadata
+		return nil
+	}
+
+	//compare the piece before multiplying, a huge piece number would overflow
+	if len(e.metadata) == 0 || msg.Piece < 0 || msg.Piece >= int64((len(e.metadata)+metadataPieceSize-1)/metadataPieceSize) {
+		reply, err := bencode.EncodeBytes(metadataMessage{MsgType: metadataReject, Piece: msg.Piece})
+		if err != nil {
+			return err
+		}
+		return t.QueueExtendedMessage(e.Name(), reply)
+	}
+
+	begin := int(msg.Piece) * metadataPieceSize
+	end := begin + metadataPieceSize
+	if end > len(e.metadata) {
+		end = len(e.metadata)
+	}
+	reply, err := bencode.EncodeBytes(metadataMessage{MsgType: metadataData, Piece: msg.Piece, TotalSize: int64(len(e.metadata))})
+	if err != nil {
+		return err
+	}
+	return t.QueueExtendedMessage(e.Name(), append(reply, e.metadata[begin:end]...))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestBencodeLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    int
+		wantErr bool
+	}{
+		{name: "integer", data: "i42e", want: 4},
+		{name: "string", data: "4:spamtrailing", want: 6},
+		{name: "empty string", data: "0:", want: 2},
+		{name: "header then piece data", data: "d8:msg_typei1e5:piecei0ee" + "rawbytes", want: 25},
+		{name: "nested", data: "ld1:ali1eeee", want: 12},
+		{name: "empty", data: "", wantErr: true},
+		{name: "unterminated integer", data: "i42", wantErr: true},
+		{name: "unterminated list", data: "li1e", wantErr: true},
+		{name: "string longer than the input", data: "10:abc", wantErr: true},
+		{name: "string length overflowing", data: "9223372036854775807:abc", wantErr: true},
+		{name: "string length past int", data: "99999999999999999999:abc", wantErr: true},
+		{name: "string without colon", data: "12", wantErr: true},
+		{name: "not bencode", data: "x", wantErr: true},
+		{name: "deepest nesting allowed", data: strings.Repeat("l", bencodeMaxDepth) + strings.Repeat("e", bencodeMaxDepth), want: 2 * bencodeMaxDepth},
+		{name: "nested too deep", data: strings.Repeat("l", bencodeMaxDepth+1) + strings.Repeat("e", bencodeMaxDepth+1), wantErr: true},
+		{name: "deep unterminated nesting", data: strings.Repeat("l", 100000), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := bencodeLength([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("malformed bencode took %d bytes", n)
+				}
+				return
+			}
+			if err != nil || n != tt.want {
+				t.Fatalf("got %d, %v, want %d", n, err, tt.want)
+			}
+		})
+	}
+}
+
+/*
+* HELPER
+* plays a peer that serves metadata over ut_metadata, each piece goes through corrupt first
+* @conn: the peer's end of the connection
+* @metadata: the info dictionary to serve
+* @corrupt: changes the data of a piece before it is sent, nil sends it as is
+ */
+func serveMetadata(conn net.Conn, info TorrentInfo, metadata []byte, corrupt func(piece int, data []byte) []byte) {
+	defer conn.Close()
+	var pkt Packet
+	pWriter := bufio.NewWriter(conn)
+	pReader := bufio.NewReader(conn)
+	if _, err := pkt.ReceiveHandshakePacket(pReader, Peer{}, info); err != nil {
+		return
+	}
+	if err := pkt.SendHandshakePacket(pWriter, info); err != nil {
+		return
+	}
+
+	const ourID = 3
+	hs, _ := bencode.EncodeBytes(ExtendedHandshake{M: map[string]int64{"ut_metadata": ourID}, MetadataSize: int64(len(metadata))})
+	if err := sendExtendedMessage(pWriter, 0, hs); err != nil {
+		return
+	}
+	var theirID int64
+	for {
+		extID, payload, err := readExtendedMessage(pReader, conn, 5)
+		if err != nil {
+			return
+		}
+		if extID == 0 {
+			var remote ExtendedHandshake
+			bencode.DecodeBytes(payload, &remote)
+			theirID = remote.M["ut_metadata"]
+			continue
+		}
+		msg, _, err := parseMetadataMessage(payload)
+		if err != nil || extID != ourID || msg.MsgType != metadataRequest {
+			return
+		}
+		begin := int(msg.Piece) * metadataPieceSize
+		end := begin + metadataPieceSize
+		if end > len(metadata) {
+			end = len(metadata)
+		}
+		data := append([]byte(nil), metadata[begin:end]...)
+		if corrupt != nil {
+			data = corrupt(int(msg.Piece), data)
+		}
+		reply, _ := bencode.EncodeBytes(metadataMessage{MsgType: metadataData, Piece: msg.Piece, TotalSize: int64(len(metadata))})
+		if err := sendExtendedMessage(pWriter, byte(theirID), append(reply, data...)); err != nil {
+			return
+		}
+	}
+}
+
+/*
+* HELPER
+* both ends of a loopback TCP connection, unlike net.Pipe both sides can write at once
+ */
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestFetchMetadataFromPeer(t *testing.T) {
+	//an info dictionary spanning three ut_metadata pieces, the last one short
+	pieces := strings.Repeat("0123456789abcdefghij", 2*metadataPieceSize/20+10)
+	metadata := []byte("d6:lengthi1e4:name1:x12:piece lengthi16384e6:pieces" + strconv.Itoa(len(pieces)) + ":" + pieces + "e")
+	hash := sha1.Sum(metadata)
+	info := TorrentInfo{ClientID: NewPeerID(), ProtoName: ProtoName, ProtoNameLen: len(ProtoName), InfoHash: string(hash[:])}
+
+	tests := []struct {
+		name    string
+		corrupt func(piece int, data []byte) []byte
+		wantErr bool
+	}{
+		{name: "assembled from every piece"},
+		{name: "piece with the wrong size", corrupt: func(piece int, data []byte) []byte {
+			if piece == 1 {
+				return data[1:]
+			}
+			return data
+		}, wantErr: true},
+		{name: "data not matching the info hash", corrupt: func(piece int, data []byte) []byte {
+			if piece == 2 {
+				data[0] ^= 0xff
+			}
+			return data
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			defer client.Close()
+			go serveMetadata(server, info, metadata, tt.corrupt)
+
+			got, err := fetchMetadataFromPeer(client, Peer{}, info, 5)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("bad metadata accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(metadata) {
+				t.Fatal("metadata assembled wrong")
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+/*
+* message stream encryption (MSE/PE)
+* a Diffie-Hellman key exchange, then an RC4 stream keyed with the shared secret and the info hash,
+* done on the connection before the BitTorrent handshake so the whole exchange looks like random bytes.
+* the side that connects is A, the side that accepts is B:
+*	A->B: Ya, PadA
+*	B->A: Yb, PadB
+*	A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+*	B->A: ENCRYPT(VC, crypto_select, len(PadD), PadD)
+* after which both sides speak the selected crypto, RC4 or plaintext
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// EncryptionMode is whether connections are encrypted with MSE
+type EncryptionMode int
+
+const (
+	EncryptionDisabled EncryptionMode = iota //plaintext only, encrypted peers are refused
+	EncryptionEnabled                        //encrypt when we can, plaintext peers are still served
+	EncryptionForced                         //RC4 only, plaintext peers are refused
+)
+
+const (
+	mseKeyLen  = 96               // bytes of a public key and of the shared secret
+	mseMaxPad  = 512              // longest padding either side may send
+	msePadLen  = 64               // longest padding we send, enough to vary the packet sizes
+	mseTimeout = 30 * time.Second // time the key exchange may take
+)
+
+// crypto_provide and crypto_select bits
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// msePrime is the 768 bit prime P of the key exchange, the generator is 2
+var msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+// mseVC is the verification constant, 8 zero bytes
+var mseVC = make([]byte, 8)
+
+// mseConn is a connection after the MSE handshake, a nil cipher means that direction is plaintext
+type mseConn struct {
+	net.Conn
+	reader  *bufio.Reader // holds bytes read past the handshake
+	pending []byte        // the initial payload of the peer, already decrypted, read before anything else
+	decrypt *rc4.Cipher
+	encrypt *rc4.Cipher
+
+	readLock  *sync.Mutex
+	writeLock *sync.Mutex
+}
+
+// Read decrypts what the peer sent
+func (c *mseConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts b, which is left untouched, and sends it
+func (c *mseConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	out := make([]byte, len(b))
+	c.encrypt.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+/*
+* connects to a peer, encrypted as far as the mode allows
+* with EncryptionEnabled a peer that fails the MSE handshake is dialed again in plaintext
+* @addr: host:port of the peer
+* @infoHash: the torrent, it keys the encryption
+* @mode: the encryption mode
+* @timeout: time a connection attempt may take
+* returns: the connection, error
+ */
+func DialPeer(addr string, infoHash string, mode EncryptionMode, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil || mode == EncryptionDisabled {
+		return conn, err
+	}
+	encrypted, err := EncryptConnection(conn, infoHash, mode)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if mode == EncryptionForced {
+		return nil, err
+	}
+	//the peer may not speak MSE at all
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+/*
+* runs the MSE handshake as the side that connected
+* @conn: the new connection
+* @infoHash: the torrent we are going to ask the peer for
+* @mode: EncryptionEnabled offers RC4 and plaintext, EncryptionForced only RC4
+* returns: the connection to send the BitTorrent handshake on, error if the peer did not complete the exchange
+ */
+func EncryptConnection(conn net.Conn, infoHash string, mode EncryptionMode) (net.Conn, error) {
+	if mode == EncryptionDisabled {
+		return conn, nil
+	}
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+
+	private, public := mseKeys()
+	if _, err := conn.Write(append(public, msePad()...)); err != nil {
+		return nil, err
+	}
+	remote := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(reader, remote); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(private, remote)
+	skey := []byte(infoHash)
+	encrypt := mseCipher("keyA", secret, skey)
+	decrypt := mseCipher("keyB", secret, skey)
+
+	provide := uint32(cryptoRC4)
+	if mode == EncryptionEnabled {
+		provide |= cryptoPlaintext
+	}
+	padC := msePad()
+	//VC, crypto_provide, len(PadC), PadC and len(IA), 0 as the handshake follows in the stream
+	header := make([]byte, 14+len(padC)+2)
+	binary.BigEndian.PutUint32(header[8:], provide)
+	binary.BigEndian.PutUint16(header[12:], uint16(len(padC)))
+	copy(header[14:], padC)
+	encrypt.XORKeyStream(header, header)
+
+	msg := mseHash([]byte("req1"), secret)
+	msg = append(msg, xorBytes(mseHash([]byte("req2"), skey), mseHash([]byte("req3"), secret))...)
+	msg = append(msg, header...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	//PadB comes before the encrypted VC, so look for the VC
+	vc := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(vc, mseVC)
+	if err := mseSync(reader, vc, mseMaxPad); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(reply, reply)
+	selected := binary.BigEndian.Uint32(reply[:4])
+	padLen := int(binary.BigEndian.Uint16(reply[4:]))
+	if padLen > mseMaxPad {
+		return nil, errors.New("EncryptConnection: padding too long")
+	}
+	padD := make([]byte, padLen)
+	if _, err := io.ReadFull(reader, padD); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	c := &mseConn{Conn: conn, reader: reader, readLock: &sync.Mutex{}, writeLock: &sync.Mutex{}}
+	switch {
+	case selected == cryptoRC4:
+		c.encrypt, c.decrypt = encrypt, decrypt
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+	default:
+		return nil, errors.New("EncryptConnection: peer selected a crypto we did not provide")
+	}
+	return c, nil
+}
+
+/*
+* tells an MSE handshake from a plaintext one on an incoming connection and answers it
+* @conn: the incoming connection
+* @infoHashes: the torrents we serve, the peer's request is matched against them
+* @mode: EncryptionDisabled refuses encrypted peers, EncryptionForced plaintext ones
+* returns: the connection to read the BitTorrent handshake from, error if the peer is refused or the exchange fails
+ */
+func AcceptEncryption(conn net.Conn, infoHashes []string, mode EncryptionMode) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	c := &mseConn{Conn: conn, reader: reader, readLock: &sync.Mutex{}, writeLock: &sync.Mutex{}}
+
+	plain := append([]byte{byte(len(ProtoName))}, ProtoName...)
+	if start, err := reader.Peek(len(plain)); err == nil && bytes.Equal(start, plain) {
+		if mode == EncryptionForced {
+			return nil, errors.New("AcceptEncryption: plaintext peer refused")
+		}
+		return c, nil
+	}
+	if mode == EncryptionDisabled {
+		return nil, errors.New("AcceptEncryption: encrypted peer refused")
+	}
+
+	remote := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(reader, remote); err != nil {
+		return nil, err
+	}
+	private, public := mseKeys()
+	if _, err := conn.Write(append(public, msePad()...)); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(private, remote)
+
+	//PadA comes before HASH('req1', S), so look for the hash
+	if err := mseSync(reader, mseHash([]byte("req1"), secret), mseMaxPad); err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader, obfuscated); err != nil {
+		return nil, err
+	}
+	req2 := xorBytes(obfuscated, mseHash([]byte("req3"), secret))
+	var skey []byte
+	for _, hash := range infoHashes {
+		if bytes.Equal(mseHash([]byte("req2"), []byte(hash)), req2) {
+			skey = []byte(hash)
+			break
+		}
+	}
+	if skey == nil {
+		return nil, errors.New("AcceptEncryption: peer asked for a torrent we do not have")
+	}
+	decrypt := mseCipher("keyA", secret, skey)
+	encrypt := mseCipher("keyB", secret, skey)
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], mseVC) {
+		return nil, errors.New("AcceptEncryption: bad verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLen := int(binary.BigEndian.Uint16(header[12:]))
+	if padLen > mseMaxPad {
+		return nil, errors.New("AcceptEncryption: padding too long")
+	}
+	padC := make([]byte, padLen+2)
+	if _, err := io.ReadFull(reader, padC); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padC, padC)
+	initial := make([]byte, binary.BigEndian.Uint16(padC[padLen:]))
+	if _, err := io.ReadFull(reader, initial); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(initial, initial)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && mode != EncryptionForced:
+		selected = cryptoPlaintext
+	default:
+		return nil, errors.New("AcceptEncryption: no crypto in common with the peer")
+	}
+	padD := msePad()
+	//VC, crypto_select, len(PadD) and PadD
+	reply := make([]byte, 14+len(padD))
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	binary.BigEndian.PutUint16(reply[12:], uint16(len(padD)))
+	copy(reply[14:], padD)
+	encrypt.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	c.pending = initial
+	if selected == cryptoRC4 {
+		c.encrypt, c.decrypt = encrypt, decrypt
+	}
+	return c, nil
+}
+
+/*
+* HELPER
+* picks a private key and computes the public key sent to the peer
+* returns: the private key, the public key padded to mseKeyLen bytes
+ */
+func mseKeys() (*big.Int, []byte) {
+	private := new(big.Int).SetBytes(randomBytes(20))
+	public := new(big.Int).Exp(big.NewInt(2), private, msePrime)
+	return private, public.FillBytes(make([]byte, mseKeyLen))
+}
+
+/*
+* HELPER
+* computes the secret S both sides share
+* @private: our private key
+* @remote: the peer's public key
+* returns: S padded to mseKeyLen bytes
+ */
+func mseSecret(private *big.Int, remote []byte) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(remote), private, msePrime)
+	return s.FillBytes(make([]byte, mseKeyLen))
+}
+
+/*
+* HELPER
+* creates the RC4 cipher of one direction, the first 1024 bytes of its key stream are thrown away
+* @name: "keyA" for the data the connecting side sends, "keyB" for the other way
+* returns: the cipher
+ */
+func mseCipher(name string, secret []byte, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+/*
+* HELPER
+* returns: the SHA1 of the parts put together
+ */
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+/*
+* HELPER
+* returns: a and b xored byte by byte, as long as a
+ */
+func xorBytes(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+/*
+* HELPER
+* returns: random padding of 0 to msePadLen bytes
+ */
+func msePad() []byte {
+	return randomBytes(mathrand.Intn(msePadLen + 1))
+}
+
+/*
+* HELPER
+* reads past the peer's padding up to and including a marker
+* @reader: the connection
+* @marker: the bytes that follow the padding
+* @maxPad: longest padding allowed
+* returns: error if the marker is not found
+ */
+func mseSync(reader *bufio.Reader, marker []byte, maxPad int) error {
+	window := make([]byte, 0, maxPad+len(marker))
+	for len(window) < maxPad+len(marker) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if len(window) >= len(marker) && bytes.Equal(window[len(window)-len(marker):], marker) {
+			return nil
+		}
+	}
+	return errors.New("mseSync: marker not found")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordingConn keeps every byte read from the connection, i.e. what went over the wire
+type recordingConn struct {
+	net.Conn
+	raw bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.raw.Write(b[:n])
+	return n, err
+}
+
+func TestMSEHandshake(t *testing.T) {
+	hash := "abcdefghijabcdefghij"
+	other := "zzzzzzzzzzzzzzzzzzzz"
+	tests := []struct {
+		name    string
+		dial    EncryptionMode
+		accept  EncryptionMode
+		serves  []string
+		wantErr bool
+		wantRC4 bool
+	}{
+		{name: "enabled", dial: EncryptionEnabled, accept: EncryptionEnabled, serves: []string{hash}, wantRC4: true},
+		{name: "forced", dial: EncryptionForced, accept: EncryptionForced, serves: []string{hash}, wantRC4: true},
+		{name: "forced dialing an enabled peer", dial: EncryptionForced, accept: EncryptionEnabled, serves: []string{hash}, wantRC4: true},
+		{name: "enabled dialing a forced peer", dial: EncryptionEnabled, accept: EncryptionForced, serves: []string{hash}, wantRC4: true},
+		{name: "one of several torrents", dial: EncryptionEnabled, accept: EncryptionEnabled, serves: []string{other, hash}, wantRC4: true},
+		{name: "plaintext dialing an enabled peer", dial: EncryptionDisabled, accept: EncryptionEnabled, serves: []string{hash}},
+		{name: "mismatched SKEY", dial: EncryptionEnabled, accept: EncryptionEnabled, serves: []string{other}, wantErr: true},
+		{name: "mismatched SKEY forced", dial: EncryptionForced, accept: EncryptionForced, serves: []string{other}, wantErr: true},
+		{name: "plaintext dialing a forced peer", dial: EncryptionDisabled, accept: EncryptionForced, serves: []string{hash}, wantErr: true},
+		{name: "encrypted dialing a plaintext peer", dial: EncryptionEnabled, accept: EncryptionDisabled, serves: []string{hash}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			wire := &recordingConn{Conn: server}
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, err := AcceptEncryption(wire, tt.serves, tt.accept)
+				if err != nil {
+					//the dialing side learns about it from the closed connection
+					server.Close()
+				}
+				accepted <- conn
+			}()
+
+			dialed, err := EncryptConnection(client, hash, tt.dial)
+			if err != nil {
+				client.Close()
+				<-accepted
+				if !tt.wantErr {
+					t.Fatal(err)
+				}
+				return
+			}
+			// the BitTorrent handshake comes first, a plaintext peer is told apart by it
+			msg := []byte("\x13BitTorrent protocol and the rest of the handshake")
+			sent := make(chan error, 1)
+			go func() {
+				_, err := dialed.Write(msg)
+				sent <- err
+			}()
+			conn := <-accepted
+			if conn == nil {
+				if !tt.wantErr {
+					t.Fatal("handshake refused")
+				}
+				return
+			}
+			defer conn.Close()
+			if tt.wantErr {
+				t.Fatal("handshake accepted")
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("accepting side read %q, %v", got, err)
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+
+			reply := []byte("and the reply of the accepting side")
+			go func() {
+				_, err := conn.Write(reply)
+				sent <- err
+			}()
+			got = make([]byte, len(reply))
+			if _, err := io.ReadFull(dialed, got); err != nil || !bytes.Equal(got, reply) {
+				t.Fatalf("dialing side read %q, %v", got, err)
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+
+			if plain := bytes.Contains(wire.raw.Bytes(), []byte(ProtoName)); plain == tt.wantRC4 {
+				t.Fatalf("handshake sent in plaintext: %v, want RC4: %v", plain, tt.wantRC4)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	//	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
@@ -14,11 +15,40 @@ import (
 type PacketHandler interface {
 	ReceiverArbitraryPacket(pRead *bufio.Reader) (Message, error)
 	SendArbitraryPacket(pWriter *bufio.Writer, packet []byte) error
-	ReceiveHandshakePacket(pRead *bufio.Reader, peer Peer, info TorrentInfo) error
+	ReceiveHandshakePacket(pRead *bufio.Reader, peer Peer, info TorrentInfo) (Handshake, error)
 	SendHandshakePacket(pWriter *bufio.Writer, info TorrentInfo) error
 }
 
-type Packet int
+// Packet reads and writes the messages of a connection, through the connection's rate limits
+type Packet struct {
+	limits RateLimits
+}
+
+// extensionProtocolBit marks support for the extension protocol (BEP 10), bit 20 of the reserved bytes
+const extensionProtocolBit = 0x10
+
+// dhtBit marks support for the DHT (BEP 5), the last bit of the reserved bytes
+const dhtBit = 0x01
+
+// maxMessageLength is the longest message we read, a 16 KiB block message or the bitfield of a torrent with up to 8 million pieces
+const maxMessageLength = 1 << 20
+
+// Handshake holds the fields of a handshake received from a peer
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash string
+	PeerID   string
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit
+func (h Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionProtocolBit != 0
+}
+
+// SupportsDHT reports whether the peer runs a DHT node and sends PORT messages
+func (h Handshake) SupportsDHT() bool {
+	return h.Reserved[7]&dhtBit != 0
+}
 
 /*
 * attemps to read an arbitrary bittorent packet type, waits for data
@@ -66,6 +96,8 @@ func (t *Packet) ReceiveArbitraryPacket(pRead *bufio.Reader, timeout int, conn n
 		return Message{}, err
 	}
 	data = append(msgLength, data...)
+	//hold off reading the next message while over a download limit
+	WaitRateLimits(len(data), t.limits.Download)
 	//form message struct
 	msg, err := NewMessage(data)
 
@@ -79,7 +111,8 @@ func (t *Packet) ReceiveArbitraryPacket(pRead *bufio.Reader, timeout int, conn n
 * @see: ReadArbitraryPacket for how to read in a packet
  */
 func (t *Packet) SendArbitraryPacket(pWrite *bufio.Writer, packet []byte) error {
-
+	//wait for the upload limits
+	WaitRateLimits(len(packet), t.limits.Upload)
 	//write it out to socket
 	return bufferWrite(pWrite, packet)
 }
@@ -88,22 +121,42 @@ func (t *Packet) SendArbitraryPacket(pWrite *bufio.Writer, packet []byte) error
 * waits for a handshake message for a given peer, used only at start of connection
 * @pRead: ptr to bufio.Reader used for reading from TCP connection
 * @peer: Peer struct used to represent the peer the current connection is for
-* returns: error
+* returns: the parsed handshake, error
 * @see: SendHandshakePacket for how to send a handshake packet
  */
-func (t *Packet) ReceiveHandshakePacket(pRead *bufio.Reader, peer Peer, info TorrentInfo) error {
+func (t *Packet) ReceiveHandshakePacket(pRead *bufio.Reader, peer Peer, info TorrentInfo) (Handshake, error) {
 	// read 1 bytes to find out pstrlen
 	pstrlen, err := pRead.ReadByte()
 	if err != nil {
-		return errors.New("Could not read handhake pstr length")
+		return Handshake{}, errors.New("Could not read handhake pstr length")
 	}
-	length := int(pstrlen) + 48 // len += 8 unset bytes + 20 peer id + 20 infohash
+	length := int(pstrlen) + 48 // len += 8 reserved bytes + 20 peer id + 20 infohash
 
 	data, err := readPacket(length, pRead)
+	if err != nil {
+		return Handshake{}, err
+	}
 	data = append([]byte{pstrlen}, data...)
 	return parseHandshakePacket(data, peer, info)
 }
 
+/*
+* reads a handshake without checking which torrent it is for, incoming connections are routed by its info hash
+* @r: the connection, read unbuffered so nothing after the handshake is consumed
+* returns: the parsed handshake, error
+ */
+func ReadHandshake(r io.Reader) (Handshake, error) {
+	pstrlen := make([]byte, 1)
+	if _, err := io.ReadFull(r, pstrlen); err != nil {
+		return Handshake{}, errors.New("Could not read handhake pstr length")
+	}
+	data := make([]byte, int(pstrlen[0])+48) // 8 reserved bytes + 20 infohash + 20 peer id
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Handshake{}, errors.New("Could not read packet")
+	}
+	return parseHandshake(append(pstrlen, data...), ProtoName)
+}
+
 /*
 * writes out a handshake packet to the TCP socket
 * @pWrite: ptr to bufio.Writer for TCP connection
@@ -128,9 +181,13 @@ func formHandshakePacket(info TorrentInfo) []byte {
 	binary.Write(buf, binary.BigEndian, byte(info.ProtoNameLen))
 	//its length
 	binary.Write(buf, binary.BigEndian, []byte(info.ProtoName))
-	//needs 8 'zero' bytes reserved
-	var zeros [8]byte
-	binary.Write(buf, binary.BigEndian, zeros)
+	//8 reserved bytes, we set the extension protocol bit and the DHT bit if we run a node
+	var reserved [8]byte
+	reserved[5] |= extensionProtocolBit
+	if info.DHT != nil {
+		reserved[7] |= dhtBit
+	}
+	binary.Write(buf, binary.BigEndian, reserved)
 	//put the infoHash in
 	binary.Write(buf, binary.BigEndian, []byte(info.InfoHash))
 	//put the client id in (our id)
@@ -141,32 +198,52 @@ func formHandshakePacket(info TorrentInfo) []byte {
 /*
 * HELPER
 * receive a handshake msg, parse its byte, and compare it to what we expect
-* returns: error or nil
+* returns: the parsed handshake, error
  */
-func parseHandshakePacket(hsk []byte, peer Peer, info TorrentInfo) error {
+func parseHandshakePacket(hsk []byte, peer Peer, info TorrentInfo) (Handshake, error) {
+	h, err := parseHandshake(hsk, info.ProtoName)
+	if err != nil {
+		return h, err
+	}
+	//compare the info hash
+	if strings.Compare(h.InfoHash, info.InfoHash) != 0 {
+		return h, errors.New("receiveHandshakeMsg: infoHasH doesn't match")
+	}
+	//compare the peer id
+	if peer.PeerID != "" && strings.Compare(h.PeerID, peer.PeerID) != 0 {
+		return h, errors.New("receiveHandshakeMsg: peerId doesn't match")
+	}
+
+	return h, nil
+
+}
+
+/*
+* HELPER
+* parse the bytes of a handshake msg, only the protocol is compared
+* @hsk: the handshake, pstrlen included
+* @protoName: the protocol we speak
+* returns: the parsed handshake, error
+ */
+func parseHandshake(hsk []byte, protoName string) (Handshake, error) {
+	var h Handshake
 	//parse and compare the version strlen
 	pstrLen := int(hsk[0])
-	if pstrLen != info.ProtoNameLen {
-		return errors.New("receiveHandshakeMsg: pstrLen doesn't match")
+	if pstrLen != len(protoName) {
+		return h, errors.New("receiveHandshakeMsg: pstrLen doesn't match")
 	}
 	//parse and compare the version string
 	pstr := string(hsk[1 : pstrLen+1])
-	if strings.Compare(pstr, info.ProtoName) != 0 {
-		return errors.New("receiveHandshakeMsg: pstr doesn't match")
-	}
-	//parse and compare the info hash
-	infoHash := string(hsk[pstrLen+9 : pstrLen+29])
-	if strings.Compare(infoHash, info.InfoHash) != 0 {
-		return errors.New("receiveHandshakeMsg: infoHasH doesn't match")
+	if strings.Compare(pstr, protoName) != 0 {
+		return h, errors.New("receiveHandshakeMsg: pstr doesn't match")
 	}
-	//parse and cmpare the peer id
-	peerID := string(hsk[pstrLen+9+20:])
-	if peer.PeerID != "" && strings.Compare(peerID, peer.PeerID) != 0 {
-		return errors.New("receiveHandshakeMsg: peerId doesn't match")
-	}
-
-	return nil
-
+	//keep the reserved bytes so we know which extensions the peer speaks
+	copy(h.Reserved[:], hsk[pstrLen+1:pstrLen+9])
+	//parse the info hash
+	h.InfoHash = string(hsk[pstrLen+9 : pstrLen+29])
+	//parse the peer id
+	h.PeerID = string(hsk[pstrLen+9+20:])
+	return h, nil
 }
 
 /*
@@ -177,18 +254,14 @@ func parseHandshakePacket(hsk []byte, peer Peer, info TorrentInfo) error {
 * returns: bytes from pakcet read in, error
  */
 func readPacket(length int, pRead *bufio.Reader) ([]byte, error) {
-
+	//the length comes from the peer, check it before allocating
+	if length < 0 || length > maxMessageLength {
+		return nil, errors.New("readPacket: bad message length")
+	}
 	data := make([]byte, length, length)
-	readData := make([]byte, length, length)
-	totalRead := 0
-	for totalRead < length {
-		nRead, err := pRead.Read(readData)
-
-		if err != nil {
-			return nil, errors.New("Could not read packet")
-		}
-		data = append(data[:totalRead], readData[:nRead]...)
-		totalRead += nRead
+	//read exactly length bytes, anything after them belongs to the next message
+	if _, err := io.ReadFull(pRead, data); err != nil {
+		return nil, errors.New("Could not read packet")
 	}
 	return data, nil
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestReadPacketLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int
+		wantErr bool
+	}{
+		{name: "empty", length: 0},
+		{name: "block message", length: BlockSize + 13},
+		{name: "negative", length: -1, wantErr: true},
+		{name: "negative prefix", length: int(int32(-2147483648)), wantErr: true},
+		{name: "over the cap", length: maxMessageLength + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(make([]byte, BlockSize+13)))
+			data, err := readPacket(tt.length, reader)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("bad length read")
+				}
+				return
+			}
+			if err != nil || len(data) != tt.length {
+				t.Fatalf("got %d bytes, %v", len(data), err)
+			}
+		})
+	}
+}
+
+func TestNewMessagePayloadLength(t *testing.T) {
+	//message builds a length prefixed message with the wire id of m
+	message := func(m MsgType, payload int) []byte {
+		msg := make([]byte, 5+payload)
+		binary.BigEndian.PutUint32(msg, uint32(1+payload))
+		msg[4] = byte(m - 1)
+		return msg
+	}
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantErr bool
+	}{
+		{name: "keep alive", msg: []byte{0, 0, 0, 0}},
+		{name: "choke", msg: message(CHOKE, 0)},
+		{name: "have", msg: message(HAVE, 4)},
+		{name: "short have", msg: message(HAVE, 3), wantErr: true},
+		{name: "request", msg: message(REQUEST, 12)},
+		{name: "short request", msg: message(REQUEST, 8), wantErr: true},
+		{name: "long cancel", msg: message(CANCEL, 13), wantErr: true},
+		{name: "piece", msg: message(PIECE, 8+BlockSize)},
+		{name: "empty piece block", msg: message(PIECE, 8)},
+		{name: "short piece", msg: message(PIECE, 7), wantErr: true},
+		{name: "port", msg: message(PORT, 2)},
+		{name: "short port", msg: message(PORT, 1), wantErr: true},
+		{name: "empty bitfield", msg: message(BITFIELD, 0)},
+		{name: "extended", msg: message(EXTENDED, 1)},
+		{name: "empty extended", msg: message(EXTENDED, 0), wantErr: true},
+		{name: "unknown id", msg: message(MsgType(100), 0), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMessage(tt.msg)
+			if tt.wantErr && err == nil {
+				t.Fatal("malformed message parsed")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReceiveBackToBackMessages(t *testing.T) {
+	have, _ := CreateMessage(HAVE, Payload{pieceIndex: 7})
+	block := bytes.Repeat([]byte{0xab}, BlockSize) //larger than the reader buffer, so it arrives in several reads
+	piece, _ := CreateMessage(PIECE, Payload{pieceIndex: 3, begin: BlockSize, block: block})
+	request, _ := CreateMessage(REQUEST, Payload{pieceIndex: 1, begin: 0, length: BlockSize})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	//all three go out in one write, so they reach the reader back to back
+	go client.Write(append(append(append([]byte(nil), have...), piece...), request...))
+
+	var p Packet
+	reader := bufio.NewReader(server)
+	msg, err := p.ReceiveArbitraryPacket(reader, 5, server)
+	if err != nil || msg.Mtype != HAVE || msg.Payload.pieceIndex != 7 {
+		t.Fatalf("first message: %+v %v", msg, err)
+	}
+	msg, err = p.ReceiveArbitraryPacket(reader, 5, server)
+	if err != nil || msg.Mtype != PIECE || msg.Payload.pieceIndex != 3 || msg.Payload.begin != BlockSize || !bytes.Equal(msg.Payload.block, block) {
+		t.Fatalf("second message: type %d piece %d begin %d, %d bytes, %v", msg.Mtype, msg.Payload.pieceIndex, msg.Payload.begin, len(msg.Payload.block), err)
+	}
+	msg, err = p.ReceiveArbitraryPacket(reader, 5, server)
+	if err != nil || msg.Mtype != REQUEST || msg.Payload.pieceIndex != 1 || msg.Payload.length != BlockSize {
+		t.Fatalf("third message: %+v %v", msg, err)
+	}
+}
@@ -12,9 +12,7 @@ import (
 	//"errors"
 	"fmt"
 	//	"log"
-	"math"
 	"net"
-	"strconv"
 	"sync"
 	//"strings"
 	"time"
@@ -28,6 +26,9 @@ type TorrentInfo struct {
 	ProtoName    string    //bittorent protocol version
 	ProtoNameLen int       //length
 	InfoHash     string    //hash for this torrent
+
+	Extensions *ExtensionRegistry //extension protocol messages we support, may be nil
+	DHT        *DHT               //our DHT node, told about nodes from PORT messages, nil if we do not run one
 }
 
 //PeerDownloader used to communicate with the list of peers
@@ -36,9 +37,9 @@ type PeerContactManager struct {
 	pieceManager   PieceManager //manages requests for pieces
 	maxConnections uint32
 	maxUnchoked    uint32
-	in             chan bool
-	out            chan bool
-	msgQueueMax    int //maxmimum number of pieces queue up for a peer
+	choker         *Choker //picks the peers we upload to
+	msgQueueMax    int     //maxmimum number of pieces queue up for a peer
+	maxRequests    int     //most block requests in flight to a single peer
 	wg             *sync.WaitGroup
 
 	inComingChanListLock *sync.Mutex
@@ -48,33 +49,69 @@ type PeerContactManager struct {
 
 	tracker        *TrackerInfo
 	waitToDownload chan bool
+	startTimer     *sync.Once //signals waitToDownload once, when the first peers arrive
+	downloaded     chan bool  //closed once every piece is downloaded
+	stopped        chan bool  //closed by StopDownload, ends the choker
+	stopOnce       *sync.Once
+
+	peers     map[string]bool             //addresses of peers we have outgoing connections to
+	selfAddrs map[string]bool             //addresses that turned out to be our own listener
+	connected map[*ConnectionManager]Peer //established connections, with the peer we dialed or an empty Peer
+	peersLock *sync.Mutex
+
+	policy     *PeerPolicy    //which peers we connect to and accept, nil admits everyone
+	encryption EncryptionMode //whether outgoing connections are encrypted, incoming ones are decided by the session
+
+	limits       RateLimits   //limits shared by every connection, e.g. the session's and the torrent's
+	peerUpload   *RateLimiter //every connection gets a fork of these, nil for no per peer limit
+	peerDownload *RateLimiter
 }
 
 /*
 NewPeerDownloader create a new peerdownloader
 * @tInfo: torrent info dictionary
-* @fileName: file to save pieces too
+* @pieceManager: the pieces we have and need, see NewPieceManager and NewSeedPieceManager
 * @maxConnections: maximum TCP connections to peers (in or out) allowed)
 * @maxUnchoked: maximum number of peers we can unchoke at once
+* @maxRequests: most block requests in flight to a single peer
+* @policy: peer admission rules for outgoing and incoming connections, nil admits everyone
 * returns: new PeerDownloader
 */
-func NewPeerContactManager(tracker *TrackerInfo, wg *sync.WaitGroup, tInfo TorrentInfo, fileName string, maxConnections uint32, maxUnchoked uint32, maxMsgQueue int) PeerContactManager {
+func NewPeerContactManager(tracker *TrackerInfo, wg *sync.WaitGroup, tInfo TorrentInfo, pieceManager PieceManager, maxConnections uint32, maxUnchoked uint32, maxMsgQueue int, maxRequests int, policy *PeerPolicy) PeerContactManager {
 	var p PeerContactManager
 	p.wg = wg
 	p.tInfo = tInfo
 	//global manager for pieces we have and need
-	p.pieceManager = NewPieceManager(tInfo.TInfo, 10, fileName)
+	p.pieceManager = pieceManager
 	//number of peers allowed to be connected to simultaneously
 	p.maxConnections = maxConnections
 	//number of peers we are allowed to unchoke
 	p.maxUnchoked = maxUnchoked
 
-	p.in = make(chan bool)  //receive requests for unchoking
-	p.out = make(chan bool) //respond to requests for unchoking
 	p.msgQueueMax = maxMsgQueue
+	p.maxRequests = maxRequests
 	p.tracker = tracker
-	p.waitToDownload = make(chan bool)
-	go func(tracker *TrackerInfo) {
+	p.waitToDownload = make(chan bool, 1)
+	p.startTimer = &sync.Once{}
+	p.downloaded = make(chan bool)
+	p.peers = make(map[string]bool)
+	p.selfAddrs = make(map[string]bool)
+	p.connected = make(map[*ConnectionManager]Peer)
+	p.peersLock = &sync.Mutex{}
+	p.policy = policy
+	p.stopped = make(chan bool)
+	p.stopOnce = &sync.Once{}
+	//p is returned by value, the choker must not hold on to this copy, only to its channel
+	downloaded := p.downloaded
+	p.choker = NewChoker(int(maxUnchoked), func() bool { return isClosed(downloaded) })
+	go p.choker.Run(p.stopped)
+	if p.pieceManager.Complete() {
+		//nothing to download, we start out seeding
+		close(p.downloaded)
+		return p
+	}
+	//the tracker learns about the completion from the loop announcing to it, see Downloaded
+	go func() {
 		status := p.pieceManager.WaitForDownload()
 		<-p.waitToDownload
 		now := time.Now()
@@ -82,148 +119,282 @@ func NewPeerContactManager(tracker *TrackerInfo, wg *sync.WaitGroup, tInfo Torre
 			select {
 			case <-status:
 				fmt.Println("Time for Download: ", time.Since(now))
-				tracker.Uploaded, tracker.Downloaded, tracker.Left = p.GetProgress()
-				if math.Abs(float64(tracker.Left)) < float64(p.tInfo.TInfo.PieceLength) {
-					tracker.Left = 0
-				}
-				tracker.sendGetRequest("completed")
 				fmt.Println("Download complete")
+				close(p.downloaded)
 				return
 
 			}
 
 		}
 
-	}(p.tracker)
+	}()
 	return p
 }
 
 /*
 
 * given a list of peers to connect too, opens up outgoing connections up to maxConnections
+* more peers can be handed over with AddPeers while the download runs
 * @peers: list of peers to contact, up to maxConnections
-* returns: error
+* returns: error, nil once the download completes
  */
 func (t *PeerContactManager) StartOutgoing(peers []Peer) error {
-	//handle the peer connection
-	writeToChan := true
-	for _, peerEntry := range peers {
-		// 1.) make TCP connection
+	t.AddPeers(peers)
+	<-t.downloaded
+
+	return nil
 
-		conn, err := net.Dial("tcp", peerEntry.IP+":"+strconv.FormatInt(peerEntry.Port, 10))
-		if writeToChan == true {
-			t.waitToDownload <- true
-			writeToChan = false
+}
+
+/*
+* opens outgoing connections to peers we are not connected to yet, up to maxConnections
+* @peers: candidate peers, e.g. from a tracker announce
+ */
+func (t *PeerContactManager) AddPeers(peers []Peer) {
+	t.startTimer.Do(func() {
+		t.waitToDownload <- true
+	})
+	for _, peerEntry := range peers {
+		if !t.policy.Admit(peerEntry) || peerEntry.PeerID == t.tInfo.ClientID {
+			continue
 		}
-		if err != nil {
-			return err
+		addr := peerEntry.Addr()
+		t.peersLock.Lock()
+		if t.peers[addr] || t.selfAddrs[addr] || uint32(len(t.peers)) >= t.maxConnections {
+			t.peersLock.Unlock()
+			continue
 		}
+		t.peers[addr] = true
+		t.peersLock.Unlock()
+
 		//spawn routine to handle connection
 		t.wg.Add(1)
-
-		go t.handler(conn, peerEntry)
-
+		go t.connect(peerEntry)
 	}
-	t.wg.Wait()
+}
 
-	return nil
+/*
+* makes the TCP connection to a peer and handles it until it closes
+* @peer: the peer to dial
+ */
+func (t *PeerContactManager) connect(peer Peer) {
+	conn, err := DialPeer(peer.Addr(), t.tInfo.InfoHash, t.encryption, 30*time.Second)
+	if err != nil {
+		fmt.Printf("Unable to connect to %s: %v\n", peer.Addr(), err)
+		t.wg.Done()
+	} else {
+		t.handler(conn, peer, nil)
+	}
 
+	//forget the peer so a later announce can bring it back
+	t.peersLock.Lock()
+	delete(t.peers, peer.Addr())
+	t.peersLock.Unlock()
 }
 
-func (t *PeerContactManager) handler(tcpConnection net.Conn, peer Peer) {
+/*
+* runs a connection until it closes
+* @tcpConnection: the connection
+* @peer: the peer we dialed, empty for incoming connections
+* @hs: the handshake an incoming peer already sent, nil for outgoing connections
+ */
+func (t *PeerContactManager) handler(tcpConnection net.Conn, peer Peer, hs *Handshake) {
 	fmt.Printf("connection to %v spawned\n", peer.IP)
 
 	//open up a new connection manager
-	manager := NewConnectionManager(&t.pieceManager, t.msgQueueMax, t.in, t.out)
+	manager := NewConnectionManager(&t.pieceManager, t.msgQueueMax, t.maxRequests, t.choker, t.policy)
+	manager.SetRateLimits(RateLimits{
+		Upload:   append(append([]*RateLimiter(nil), t.limits.Upload...), t.peerUpload.Fork()),
+		Download: append(append([]*RateLimiter(nil), t.limits.Download...), t.peerDownload.Fork()),
+	})
 	//start up the connection
-	if err := manager.StartConnection(tcpConnection, peer, t.tInfo, 120, 2); err != nil {
+	var err error
+	if hs != nil {
+		err = manager.AcceptConnection(tcpConnection, *hs, t.tInfo, 120, 2)
+	} else {
+		err = manager.StartConnection(tcpConnection, peer, t.tInfo, 120, 2)
+	}
+	if err != nil {
+		if err == errSelfConnection && peer.IP != "" {
+			//never dial this address again
+			t.peersLock.Lock()
+			t.selfAddrs[peer.Addr()] = true
+			t.peersLock.Unlock()
+		}
 
 		//fmt.Printf("Failed to connect to %v: %v\n", tcpConnection.RemoteAddr(), err)
 		tcpConnection.Close()
 		t.wg.Done()
 		return
 	}
+	t.choker.Add(&manager)
+	defer t.choker.Remove(&manager)
+	t.peersLock.Lock()
+	t.connected[&manager] = peer
+	t.peersLock.Unlock()
+	defer func() {
+		t.peersLock.Lock()
+		delete(t.connected, &manager)
+		t.peersLock.Unlock()
+	}()
+	//worth trying again after a restart
+	t.pieceManager.AddKnownPeer(peer)
+
 	//loop receiving and sending messages
 	//send loop ( this might possibly speed things up
 
-	errChan := make(chan error)
-	go func(errChan chan error) {
+	//sendFailed gets the send loop's error, done is closed once the receive loop stopped, neither side ever blocks on the other
+	sendFailed := make(chan error, 1)
+	done := make(chan bool)
+	go func() {
 		for {
-			err := manager.SendNextMessage()
-			if err != nil {
-				errChan <- err
+			if err := manager.SendNextMessage(); err != nil {
+				sendFailed <- err
 				return
 			}
 
 			select {
-			case <-errChan:
+			case <-done:
 				return
 			default:
 			}
 
 		}
-	}(errChan)
+	}()
 	//receive loop
+receive:
 	for {
-		err := manager.ReceiveNextMessage()
-		if err != nil {
-			errChan <- err
+		if err := manager.ReceiveNextMessage(); err != nil {
 			break
 		}
 		select {
-
-		case <-errChan:
-			break
-		case <-t.in: //just unchoke all peers
-			t.out <- true
+		case <-sendFailed:
+			break receive
 		default:
 		}
 	}
+	close(done)
 
 	manager.StopConnection()
+	uploaded, downloaded := t.pieceManager.ConnectionProgress(manager.descriptor)
+	fmt.Printf("connection to %v closed, uploaded %d bytes, downloaded %d bytes\n", tcpConnection.RemoteAddr(), uploaded, downloaded)
 	tcpConnection.Close()
 	t.wg.Done()
 
 }
-func (t *PeerContactManager) GetProgress() (int, int, int) {
-	return t.pieceManager.GetProgress()
+/*
+* keeps serving peers once the download is complete
+* @ratio: stop once we uploaded ratio times the torrent's size, 0 for no limit
+* @limit: stop after seeding this long, 0 for no limit
+ */
+func (t *PeerContactManager) Seed(ratio float64, limit time.Duration) {
+	<-t.downloaded
+	fmt.Println("Seeding...")
+	start := time.Now()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if limit > 0 && time.Since(start) >= limit {
+			fmt.Println("Seeding time limit reached")
+			return
+		}
+		uploaded, _, _ := t.GetProgress()
+		if ratio > 0 && float64(uploaded) >= ratio*float64(t.tInfo.TInfo.TotalLength()) {
+			fmt.Println("Share ratio reached")
+			return
+		}
+	}
 }
 
-func (t *PeerContactManager) StopDownload() error {
-	// Stop go functions here ?
+/*
+* HELPER
+* with the downloaded channel: whether every piece is downloaded, the choker then ranks peers by upload rate
+* returns: whether the channel is closed, for channels that are only ever closed
+ */
+func isClosed(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
 
-	return t.pieceManager.SaveProgress()
+/*
+* returns: a channel closed once the download is complete, closed from the start when there was nothing to download
+ */
+func (t *PeerContactManager) Downloaded() <-chan bool {
+	return t.downloaded
 }
 
 /*
-* opens up a listener to listen for incoming peer connections
-* @port to openup listener on
-* returns error
+* lists the established connections, e.g. for peer exchange
+* returns: every connection with the address its peer listens on, "" if the peer connected to us and never told its port
  */
-func (t *PeerContactManager) StartIncoming(port uint32) error {
-	// listen on all network interfaces on port input
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
-	if err != nil {
-		return err
+func (t *PeerContactManager) Connections() map[*ConnectionManager]string {
+	t.peersLock.Lock()
+	defer t.peersLock.Unlock()
+	conns := make(map[*ConnectionManager]string, len(t.connected))
+	for conn, peer := range t.connected {
+		if peer.IP != "" {
+			conns[conn] = peer.Addr()
+		} else {
+			conns[conn] = conn.PeerListenAddr()
+		}
 	}
-	defer ln.Close()
+	return conns
+}
 
-	for {
-		conn, err := ln.Accept()
+func (t *PeerContactManager) GetProgress() (int, int, int) {
+	return t.pieceManager.GetProgress()
+}
 
-		if err != nil {
-			return err
-		}
-		t.wg.Add(1)
-		go t.incomingHandler(conn)
+/*
+* sets the bandwidth limits of connections started from now on, the rates stay adjustable through the limiters
+* @limits: limiters every connection shares
+* @peerUpload: per peer upload limit, every connection gets its own fork, nil for none
+* @peerDownload: per peer download limit, like peerUpload
+ */
+func (t *PeerContactManager) SetRateLimits(limits RateLimits, peerUpload *RateLimiter, peerDownload *RateLimiter) {
+	t.limits = limits
+	t.peerUpload = peerUpload
+	t.peerDownload = peerDownload
+}
 
-	}
+/*
+* chooses whether connections we make are encrypted
+* @mode: EncryptionDisabled, EncryptionEnabled or EncryptionForced
+ */
+func (t *PeerContactManager) SetEncryption(mode EncryptionMode) {
+	t.encryption = mode
+}
 
-	return nil
+/*
+* chooses the order pieces are requested in
+* @selection: RarestFirst or Linear
+ */
+func (t *PeerContactManager) SetPieceSelection(selection PieceSelection) {
+	t.pieceManager.SetPieceSelection(selection)
 }
 
-func (t *PeerContactManager) incomingHandler(conn net.Conn) {
-	fmt.Println(conn.LocalAddr().String(), " Got connection from ", conn.RemoteAddr().String())
-	t.handler(conn, Peer{})
+/*
+* stops the choker and saves the progress, the connections are closed by their owner
+* returns: error if the progress cannot be saved
+ */
+func (t *PeerContactManager) StopDownload() error {
+	t.stopOnce.Do(func() {
+		close(t.stopped)
+	})
+	fmt.Println("Saving progress...")
+	return t.pieceManager.SaveProgress()
+}
 
+/*
+* handles an incoming peer connection, its handshake was already read to find the torrent
+* @conn: the connection
+* @hs: the handshake the peer sent
+ */
+func (t *PeerContactManager) Accept(conn net.Conn, hs Handshake) {
+	t.wg.Add(1)
+	go t.handler(conn, Peer{}, &hs)
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// PeerIDPrefix is the Azureus style client prefix of our peer ids (BEP 20): client code MM, version 0001
+const PeerIDPrefix = "-MM0001-"
+
+// peerIDChars are the characters used for the random part of a peer id, chosen so ids stay printable
+const peerIDChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// errSelfConnection is returned when the handshake shows we dialed ourselves
+var errSelfConnection = errors.New("connected to ourselves")
+
+//NewPeerID returns a 20 byte peer id made of PeerIDPrefix and random characters
+func NewPeerID() string {
+	random := make([]byte, 20-len(PeerIDPrefix))
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	for i, b := range random {
+		random[i] = peerIDChars[int(b)%len(peerIDChars)]
+	}
+	return PeerIDPrefix + string(random)
+}
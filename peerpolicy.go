@@ -0,0 +1,213 @@
+package main
+
+/*
+* decides which peers we connect to and which incoming connections we accept
+* rules match on peer id prefix, IP address or network, and client type
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// PeerPolicy holds allow and deny rules for peers
+// a deny rule always wins, and a non empty allow list admits only the peers it matches
+type PeerPolicy struct {
+	AllowPeerIDPrefixes []string
+	DenyPeerIDPrefixes  []string
+	AllowNetworks       []*net.IPNet
+	DenyNetworks        []*net.IPNet
+	AllowClients        []string // client codes from the peer id, e.g. "qB" or "TR", see peerClient
+	DenyClients         []string
+}
+
+/*
+* reads a policy file, one rule per line in the form "<allow|deny> <peerid|ip|client> <value>"
+* ip values are single addresses or CIDR networks, lines starting with # are comments
+* @path: the policy file
+* returns: the policy, error
+ */
+func LoadPeerPolicy(path string) (*PeerPolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var p PeerPolicy
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("LoadPeerPolicy: line %d: expected <allow|deny> <peerid|ip|client> <value>", lineNum)
+		}
+		if err := p.AddRule(fields[0], fields[1], fields[2]); err != nil {
+			return nil, fmt.Errorf("LoadPeerPolicy: line %d: %v", lineNum, err)
+		}
+	}
+	return &p, scanner.Err()
+}
+
+/*
+* adds a single rule
+* @action: allow or deny
+* @kind: peerid, ip or client
+* @value: the peer id prefix, IP address or CIDR network, or client code
+* returns: error
+ */
+func (p *PeerPolicy) AddRule(action string, kind string, value string) error {
+	if action != "allow" && action != "deny" {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	allow := action == "allow"
+
+	switch kind {
+	case "peerid":
+		if allow {
+			p.AllowPeerIDPrefixes = append(p.AllowPeerIDPrefixes, value)
+		} else {
+			p.DenyPeerIDPrefixes = append(p.DenyPeerIDPrefixes, value)
+		}
+	case "ip":
+		network, err := parseNetwork(value)
+		if err != nil {
+			return err
+		}
+		if allow {
+			p.AllowNetworks = append(p.AllowNetworks, network)
+		} else {
+			p.DenyNetworks = append(p.DenyNetworks, network)
+		}
+	case "client":
+		if allow {
+			p.AllowClients = append(p.AllowClients, value)
+		} else {
+			p.DenyClients = append(p.DenyClients, value)
+		}
+	default:
+		return fmt.Errorf("unknown rule type %q", kind)
+	}
+	return nil
+}
+
+/*
+* HELPER
+* parses a CIDR network, a bare address becomes a network holding just that address
+ */
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+/*
+* checks a peer from a tracker or other source before we dial it
+* the peer id is only checked when the source gave one
+* @peer: the candidate
+* returns: whether we may connect
+ */
+func (p *PeerPolicy) Admit(peer Peer) bool {
+	if !p.AdmitAddress(net.ParseIP(peer.IP)) {
+		return false
+	}
+	return peer.PeerID == "" || p.AdmitPeerID(peer.PeerID)
+}
+
+/*
+* checks the IP rules, used for incoming connections before the handshake
+* @ip: the peer's address, nil if it is not an IP address
+* returns: whether the address is admitted
+ */
+func (p *PeerPolicy) AdmitAddress(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+	for _, network := range p.DenyNetworks {
+		if ip != nil && network.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.AllowNetworks) == 0 {
+		return true
+	}
+	for _, network := range p.AllowNetworks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* checks the peer id and client rules, used once the handshake is received
+* @peerID: the peer's 20 byte id
+* returns: whether the peer id is admitted
+ */
+func (p *PeerPolicy) AdmitPeerID(peerID string) bool {
+	if p == nil {
+		return true
+	}
+	client := peerClient(peerID)
+	for _, prefix := range p.DenyPeerIDPrefixes {
+		if strings.HasPrefix(peerID, prefix) {
+			return false
+		}
+	}
+	for _, code := range p.DenyClients {
+		if client == code {
+			return false
+		}
+	}
+
+	if len(p.AllowPeerIDPrefixes) > 0 {
+		allowed := false
+		for _, prefix := range p.AllowPeerIDPrefixes {
+			allowed = allowed || strings.HasPrefix(peerID, prefix)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(p.AllowClients) > 0 {
+		allowed := false
+		for _, code := range p.AllowClients {
+			allowed = allowed || client == code
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+* HELPER
+* extracts the client code from a peer id
+* Azureus style ids ("-qB4250-...") give the two letters, Shadow and Mainline style ids give the first letter
+* returns: the client code, empty if the id follows neither convention
+ */
+func peerClient(peerID string) string {
+	if len(peerID) >= 8 && peerID[0] == '-' && peerID[7] == '-' {
+		return peerID[1:3]
+	}
+	if len(peerID) > 0 && (peerID[0] >= 'A' && peerID[0] <= 'Z' || peerID[0] >= 'a' && peerID[0] <= 'z') {
+		return peerID[:1]
+	}
+	return ""
+}
@@ -0,0 +1,243 @@
+package main
+
+/*
+* peer exchange, ut_pex (BEP 11)
+* connected peers tell each other which peers they connected to and dropped since the last message,
+* so a torrent keeps finding peers after the tracker's first response
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	pexInterval    = time.Minute      // time between two messages to the same peer
+	pexMinInterval = 45 * time.Second // messages a peer sends faster than this are ignored
+	pexMaxPeers    = 50               // most added or dropped peers in a single message, either way
+	pexPeerBudget  = 200              // most peers handed to the pool per pexInterval, over all connections
+)
+
+// pexConnectable is the ut_pex flag of an added peer that accepts incoming connections
+const pexConnectable = 0x10
+
+//pexMessage is the bencoded ut_pex payload, peers are compact IP and port strings
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// PexExtension exchanges peer lists with connected peers over ut_pex
+type PexExtension struct {
+	port int          // our listen port, advertised so peers that accepted us can pass it on
+	pool func([]Peer) // receives the peers we learn about, e.g. PeerContactManager.AddPeers
+
+	sent     map[*ConnectionManager]map[string]bool // addresses each connection was told about
+	received map[*ConnectionManager]time.Time       // when each connection last sent us a message
+
+	budget      int       // peers still accepted before budgetReset
+	budgetReset time.Time // when budget is refilled
+
+	lock *sync.Mutex
+}
+
+/*
+* create the ut_pex extension
+* @port: our listen port
+* @pool: called with the peers learned from other peers
+* returns: the extension
+ */
+func NewPexExtension(port int, pool func([]Peer)) *PexExtension {
+	return &PexExtension{
+		port:     port,
+		pool:     pool,
+		sent:     make(map[*ConnectionManager]map[string]bool),
+		received: make(map[*ConnectionManager]time.Time),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// Name is the ut_pex extension name
+func (e *PexExtension) Name() string {
+	return "ut_pex"
+}
+
+// ExtendHandshake advertises our listen port, peers only know the port of the connections they dialed
+func (e *PexExtension) ExtendHandshake(hs *ExtendedHandshake) {
+	hs.P = int64(e.port)
+}
+
+/*
+* hands the peers a connection added to the pool
+* messages coming faster than pexMinInterval and peers over the budget are dropped, so peers cannot flood us
+* @t: connection the message came in on
+* @payload: the ut_pex message
+* returns: error
+ */
+func (e *PexExtension) HandleMessage(t *ConnectionManager, payload []byte) error {
+	var msg pexMessage
+	if err := bencode.DecodeBytes(payload, &msg); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	now := time.Now()
+	if last, ok := e.received[t]; ok && now.Sub(last) < pexMinInterval {
+		e.lock.Unlock()
+		return nil
+	}
+	e.received[t] = now
+
+	peers := append(parseCompactPeers([]byte(msg.Added), net.IPv4len), parseCompactPeers([]byte(msg.Added6), net.IPv6len)...)
+	if len(peers) > pexMaxPeers {
+		peers = peers[:pexMaxPeers]
+	}
+	if now.After(e.budgetReset) {
+		e.budget = pexPeerBudget
+		e.budgetReset = now.Add(pexInterval)
+	}
+	if len(peers) > e.budget {
+		peers = peers[:e.budget]
+	}
+	e.budget -= len(peers)
+	e.lock.Unlock()
+
+	if len(peers) > 0 && e.pool != nil {
+		fmt.Printf("PEX: %d peers from %v\n", len(peers), t.conn.RemoteAddr())
+		e.pool(peers)
+	}
+	return nil
+}
+
+/*
+* sends every connection that supports ut_pex the peers added and dropped since its last message
+* connections get the full list in their first message, at most pexMaxPeers each way, the rest follows later
+* @conns: the torrent's connections with the address each peer listens on, "" if unknown
+ */
+func (e *PexExtension) Update(conns map[*ConnectionManager]string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	//state of closed connections goes
+	for conn := range e.sent {
+		if _, ok := conns[conn]; !ok {
+			delete(e.sent, conn)
+		}
+	}
+	for conn := range e.received {
+		if _, ok := conns[conn]; !ok {
+			delete(e.received, conn)
+		}
+	}
+
+	current := make(map[string]bool)
+	for _, addr := range conns {
+		if addr != "" {
+			current[addr] = true
+		}
+	}
+
+	for conn, own := range conns {
+		if _, ok := conn.PeerExtensionID(e.Name()); !ok {
+			continue
+		}
+		sent, ok := e.sent[conn]
+		if !ok {
+			sent = make(map[string]bool)
+			e.sent[conn] = sent
+		}
+
+		var added, dropped []string
+		for addr := range current {
+			if addr != own && !sent[addr] && len(added) < pexMaxPeers {
+				added = append(added, addr)
+			}
+		}
+		for addr := range sent {
+			if !current[addr] && len(dropped) < pexMaxPeers {
+				dropped = append(dropped, addr)
+			}
+		}
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		payload, err := bencode.EncodeBytes(newPexMessage(added, dropped))
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if err := conn.QueueExtendedMessage(e.Name(), payload); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for _, addr := range added {
+			sent[addr] = true
+		}
+		for _, addr := range dropped {
+			delete(sent, addr)
+		}
+	}
+}
+
+/*
+* HELPER
+* packs addresses into a ut_pex message, IPv4 and IPv6 peers go into their own keys
+* @added: host:port of peers connected since the last message
+* @dropped: host:port of peers disconnected since the last message
+* returns: the message
+ */
+func newPexMessage(added []string, dropped []string) pexMessage {
+	var msg pexMessage
+	for _, addr := range added {
+		if b, ok := compactAddr(addr); ok && len(b) == net.IPv4len+2 {
+			msg.Added += string(b)
+			msg.AddedF += string([]byte{pexConnectable})
+		} else if ok {
+			msg.Added6 += string(b)
+			msg.Added6F += string([]byte{pexConnectable})
+		}
+	}
+	for _, addr := range dropped {
+		if b, ok := compactAddr(addr); ok && len(b) == net.IPv4len+2 {
+			msg.Dropped += string(b)
+		} else if ok {
+			msg.Dropped6 += string(b)
+		}
+	}
+	return msg
+}
+
+/*
+* HELPER
+* packs a host:port into the compact form, 4 or 16 address bytes then the port
+* @addr: host:port
+* returns: the packed address, false if addr is not an IP address with a port
+ */
+func compactAddr(addr string) ([]byte, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	p, err := net.LookupPort("tcp", port)
+	if ip == nil || err != nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	b := make([]byte, len(ip)+2)
+	copy(b, ip)
+	binary.BigEndian.PutUint16(b[len(ip):], uint16(p))
+	return b, true
+}
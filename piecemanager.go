@@ -10,12 +10,72 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/rand"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-	//"os"
-	"io"
+)
+
+// BlockSize is the size of a block requested with a single REQUEST message, the last block of a piece may be shorter
+const BlockSize = 16384
+
+/*
+* a block of a piece, what a single REQUEST message asks for
+ */
+type BlockRequest struct {
+	Piece  int
+	Begin  int
+	Length int
+}
+
+// endgameMaxDuplicates is how many peers a block may be requested from at once in endgame mode
+const endgameMaxDuplicates = 3
+
+// cancelQueueSize is how many pending cancels a connection holds, further ones are dropped and the duplicate block is simply ignored
+const cancelQueueSize = 256
+
+// maxResumePeers is how many known peers the resume data keeps, the oldest are dropped first
+const maxResumePeers = 50
+
+// PieceSelection is the order in which pieces are requested
+type PieceSelection int
+
+const (
+	RarestFirst PieceSelection = iota //pieces the fewest connected peers have first
+	Linear                            //pieces in index order
 )
 
+/*
+* collects the blocks of a piece until all of them arrived and the piece can be verified
+ */
+type pieceBuffer struct {
+	data     []byte //the piece, filled in block by block
+	received []bool //which blocks are in data
+	from     []int  //connection descriptor each block came from, credited once the piece checks out, -1 for blocks from the resume data
+	missing  int    //number of blocks still missing
+}
+
+/*
+* payload byte totals, kept behind a pointer so copies of the owner share them and atomic access stays aligned
+ */
+type byteCounts struct {
+	uploaded   int64 //bytes of PIECE messages sent
+	downloaded int64 //bytes of pieces that passed their hash check
+}
+
+/*
+* what saving the resume data needs besides the pieces, kept behind a pointer so copies of the owner share it
+ */
+type resumeState struct {
+	infoHash string
+	peers    []Peer      //peers we completed a handshake with, oldest first
+	dirty    int32       //set when the progress changed, cleared by a save
+	saveNow  chan bool   //asks for a save right away, e.g. when a piece completed
+	lock     *sync.Mutex //one save at a time, guards peers
+}
+
 /*
 * manages pieces for a single peer connection
  */
@@ -23,6 +83,14 @@ type ConnectionPieceManager struct {
 	requestQueue []int  //holds the next pieces to request
 	peerField    []byte //pieces the peer has
 
+	currentPiece int            //piece whose blocks we are requesting, -1 if none
+	blockQueue   []BlockRequest //blocks of currentPiece not requested yet
+	inFlight     []BlockRequest //blocks requested from the peer and not received yet, guarded by the PieceManager mutex
+
+	cancelQueue chan BlockRequest //in flight blocks another peer delivered first
+
+	counts *byteCounts //payload exchanged with this peer
+
 	haveBroadcastQueue chan int32 //used to receive a have broadcast
 }
 
@@ -40,6 +108,13 @@ type PieceManager struct {
 	manager        []*ConnectionPieceManager //manages piece queues for a given peer
 	numConnections int
 
+	partial map[int]*pieceBuffer //pieces with some but not all blocks received
+
+	endgame map[BlockRequest]bool //blocks still missing once endgame mode started, nil before
+
+	availability []int          //number of connected peers that have each piece
+	selection    PieceSelection //order pieces are requested in
+
 	fileWriter *FileWriter
 	infoDict   *InfoDict
 
@@ -47,59 +122,149 @@ type PieceManager struct {
 	managerMutex *sync.Mutex
 
 	downloadStatus chan<- byte
+
+	counts *byteCounts //payload exchanged with all peers, persisted with the bitfield
+
+	resume *resumeState //nil if the progress is not saved, e.g. when seeding data we did not download
 }
 
 /*
 NewPieceManager constructor
+ the download picks up from the resume data, its bitfield is only trusted if the data files have not changed since it was saved,
+ otherwise every piece is hash checked. the resume data is saved every few seconds and whenever a piece completes
  @tInfo: contains information of about the torrent [pieceLength,length] see torrent.go
+ @infoHash: hash of the torrent, resume data for other torrents is ignored
  @requestQueueSize: capacity for requestQueue slice [remains constant]
+ @recheck: hash check every piece even if the data files look unchanged
  returns: returns new PieceManager
 */
-func NewPieceManager(tInfo *InfoDict, requestQueueSize int, fileName string) PieceManager {
+func NewPieceManager(tInfo *InfoDict, infoHash string, requestQueueSize int, fileName string, recheck bool) PieceManager {
 	//create new piecemanager
 	var p PieceManager
 	//number of pieces in total
-	numPieces := math.Ceil(float64(tInfo.Length) / float64(tInfo.PieceLength))
-	//store the request queue capacity
-	p.maxQueueSize = requestQueueSize
+	numPieces := float64(tInfo.NumPieces())
 	//number of bytes in bitField for client
 	numBytes := math.Ceil(numPieces / 8)
 
 	//create file writer
-	fW := NewFileWriter(tInfo, fileName, int64(numBytes))
+	fW := NewFileWriter(tInfo, fileName)
+	p.fileWriter = &fW
+	p.resume = &resumeState{infoHash: infoHash, saveNow: make(chan bool, 1), lock: &sync.Mutex{}}
+
+	//get bitfield from the resume data
+	resume := p.loadResumeData(int(numBytes))
+	p.bitField = make([]byte, int(numBytes))
+	copy(p.bitField, resume.BitField)
+	if recheck || !p.dataUnchanged(resume) {
+		fmt.Println("Checking pieces on disk...")
+		p.bitField = fW.Recheck()
+	}
+	p.setup(tInfo, requestQueueSize)
+	p.restoreResumeData(resume)
+	go p.saveLoop()
+	return p
+}
+
+/*
+NewVerifyPieceManager hash checks every piece of a download on disk, its data files are opened read only
+ @tInfo: contains information of about the torrent [pieceLength,length] see torrent.go
+ @infoHash: info hash of the torrent, resume data of other torrents is ignored
+ @requestQueueSize: capacity for requestQueue slice [remains constant]
+ @fileName: output file of the download, see NewFileWriter
+ returns: new PieceManager, its resume data is only saved by SaveProgress, error if a data file is missing or has the wrong length
+*/
+func NewVerifyPieceManager(tInfo *InfoDict, infoHash string, requestQueueSize int, fileName string) (PieceManager, error) {
+	var p PieceManager
+	if len(tInfo.Files) > 0 && !safePathPart(tInfo.Name) {
+		return p, fmt.Errorf("NewVerifyPieceManager: unsafe torrent name %q", tInfo.Name)
+	}
+	dataPath, resumePath := downloadPaths(tInfo, fileName)
+	fW, err := OpenFileWriter(tInfo, dataPath)
+	if err != nil {
+		return p, err
+	}
+	fW.ResumePath = resumePath
 	p.fileWriter = &fW
+	p.resume = &resumeState{infoHash: infoHash, saveNow: make(chan bool, 1), lock: &sync.Mutex{}}
+
+	//totals and known peers are kept, the bitfield is replaced by what is on disk
+	resume := p.loadResumeData((tInfo.NumPieces() + 7) / 8)
+	p.bitField = fW.Recheck()
+	p.setup(tInfo, requestQueueSize)
+	p.restoreResumeData(resume)
+	return p, nil
+}
 
-	//get bitfield from file
-	p.bitField = p.LoadBitFieldFromFile(int(numBytes))
-	/*fmt.Println(p.bitField)
-	for i := 0; i < 64; i++ {
-		p.bitField[i] = 255
+/*
+NewSeedPieceManager creates a piece manager for data that is already on disk, every piece is hash checked first
+ @tInfo: contains information of about the torrent [pieceLength,length] see torrent.go
+ @requestQueueSize: capacity for requestQueue slice [remains constant]
+ @dataPath: the file of a single file torrent, the directory holding the files of a multi file torrent
+ returns: returns new PieceManager, error if the data is missing or a piece does not match the torrent
+*/
+func NewSeedPieceManager(tInfo *InfoDict, requestQueueSize int, dataPath string) (PieceManager, error) {
+	var p PieceManager
+	fW, err := OpenFileWriter(tInfo, dataPath)
+	if err != nil {
+		return p, err
+	}
+	p.fileWriter = &fW
 
-	}*/
-	p.bitField[63] |= 2
+	numPieces := tInfo.NumPieces()
+	p.bitField = fW.Recheck()
+	bad := 0
+	for index := 0; index < numPieces; index++ {
+		if !p.havePiece(index) {
+			bad++
+		}
+	}
+	if bad > 0 {
+		fW.Finish()
+		return p, fmt.Errorf("NewSeedPieceManager: %d of %d pieces do not match the torrent", bad, numPieces)
+	}
+	p.setup(tInfo, requestQueueSize)
+	return p, nil
+}
+
+/*
+* HELPER
+* initializes everything but the file writer and our bitfield
+ */
+func (t *PieceManager) setup(tInfo *InfoDict, requestQueueSize int) {
+	numPieces := tInfo.NumPieces()
+	//store the request queue capacity
+	t.maxQueueSize = requestQueueSize
 	//pieces which peers have claimed responsbility
-	p.transitField = make([]byte, int(numBytes), int(numBytes))
+	t.transitField = make([]byte, len(t.bitField), len(t.bitField))
 
-	p.numConnections = 0
+	t.numConnections = 0
 
-	p.infoDict = tInfo
+	t.infoDict = tInfo
 
-	p.mutex = &sync.Mutex{}
+	t.mutex = &sync.Mutex{}
+	t.partial = make(map[int]*pieceBuffer)
+	t.availability = make([]int, numPieces)
+	t.selection = RarestFirst
 
-	p.managerMutex = &sync.Mutex{}
-	fmt.Printf("%v\n", p.bitField)
+	t.managerMutex = &sync.Mutex{}
+	t.counts = &byteCounts{}
+	fmt.Printf("%v\n", t.bitField)
 
-	p.downloadStatus = make(chan<- byte, int32(numPieces))
+	t.downloadStatus = make(chan<- byte, numPieces)
 	//p.downloadStatus <- byte(1)
-	for _, entry := range p.bitField {
+	for _, entry := range t.bitField {
 		for _, offset := range []uint{0, 1, 2, 3, 4, 5, 6, 7} {
 			if entry&(1<<(7-offset)) != 0 {
-				p.downloadStatus <- byte(1)
+				t.downloadStatus <- byte(1)
 			}
 		}
 	}
-	//fmt.Printf("Len: %v\n", len(p.downloadStatus))
-	return p
+	//fmt.Printf("Len: %v\n", len(t.downloadStatus))
+}
+
+// Complete reports whether we have every piece
+func (t *PieceManager) Complete() bool {
+	return len(t.downloadStatus) == cap(t.downloadStatus)
 }
 
 //returns a channel to get notified of download completion
@@ -119,49 +284,96 @@ func (t *PieceManager) WaitForDownload() <-chan bool {
 
 }
 
-// Returns the bitfield from the metadata file
-// Creates an empty bitfield if there was an error
-func (t *PieceManager) LoadBitFieldFromFile(size int) []byte {
-	data, err := t.fileWriter.GetMetaData(size)
-	if err != nil && err != io.EOF {
-		return make([]byte, size, size)
-	}
-	//	fmt.Printf("%v\n", data)
-	return data
-}
-
 /*
 * create a piece manager for a new connection
 * returns: connection descriptor
  */
 func (t *PieceManager) RegisterConnection(peerField []byte) int {
-	conNum := t.numConnections
-	t.numConnections++
-
 	var con ConnectionPieceManager
-	t.manager = append(t.manager, &con)
-
 	con.peerField = make([]byte, cap(t.bitField), cap(t.bitField))
 	copy(con.peerField, peerField)
-	t.manager[conNum].requestQueue = make([]int, 0, t.maxQueueSize)
+	t.mutex.Lock()
+	for piece := range t.availability {
+		if con.peerField[piece/8]&(1<<(7-uint32(piece%8))) != 0 {
+			t.availability[piece]++
+		}
+	}
+	t.mutex.Unlock()
+	con.requestQueue = make([]int, 0, t.maxQueueSize)
+	con.currentPiece = -1
 	//used to receive have broadcasts
-	t.manager[conNum].haveBroadcastQueue = make(chan int32, cap(t.bitField)*8)
+	con.haveBroadcastQueue = make(chan int32, cap(t.bitField)*8)
+	con.cancelQueue = make(chan BlockRequest, cancelQueueSize)
+	con.counts = &byteCounts{}
+
+	t.managerMutex.Lock()
+	conNum := t.numConnections
+	t.numConnections++
+	t.manager = append(t.manager, &con)
+	t.managerMutex.Unlock()
 	return conNum
 }
 
-func (t *PieceManager) UnregisterConnection(connection int, lastPieceRequest int) {
+/*
+* gives back the pieces a connection claimed, including those with blocks in flight, so other connections can request them
+* blocks already received stay in their piece buffer, only the missing ones are requested again
+* @connection: connection descriptor
+ */
+func (t *PieceManager) UnregisterConnection(connection int) {
+	con := t.connection(connection)
 	t.mutex.Lock()
-	for _, index := range t.manager[connection].requestQueue {
-		byteIndex := index / 8
-		offset := uint32(index % 8)
-
-		t.transitField[byteIndex] &= ^(1 << (7 - offset))
+	released := append([]int(nil), con.requestQueue...)
+	if con.currentPiece != -1 {
+		released = append(released, con.currentPiece)
 	}
-	if lastPieceRequest != -1 {
-		t.transitField[lastPieceRequest/8] &= ^(1 << (7 - uint32(lastPieceRequest%8)))
+	for _, block := range con.inFlight {
+		released = append(released, block.Piece)
+	}
+	con.inFlight = nil
+	//in endgame other connections may be fetching the same pieces, those stay claimed
+	inFlightElsewhere := make(map[int]bool)
+	for _, other := range t.connections() {
+		for _, block := range other.inFlight {
+			inFlightElsewhere[block.Piece] = true
+		}
+	}
+	for _, index := range released {
+		if !inFlightElsewhere[index] {
+			t.transitField[index/8] &= ^(1 << (7 - uint32(index%8)))
+		}
 	}
-
 	t.mutex.Unlock()
+
+	con.requestQueue = make([]int, 0, t.maxQueueSize)
+	con.currentPiece = -1
+	con.blockQueue = nil
+}
+
+/*
+* @connection: connection descriptor
+* returns: number of blocks requested from the peer that have not arrived yet
+ */
+func (t *PieceManager) NumInFlight(connection int) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.connection(connection).inFlight)
+}
+
+/*
+* collects the blocks to cancel because another peer delivered them first
+* @connection: connection descriptor
+* returns: the blocks, no longer counted as in flight
+ */
+func (t *PieceManager) NextCancels(connection int) []BlockRequest {
+	var cancels []BlockRequest
+	for {
+		select {
+		case block := <-t.connection(connection).cancelQueue:
+			cancels = append(cancels, block)
+		default:
+			return cancels
+		}
+	}
 }
 
 /**
@@ -176,74 +388,113 @@ func (t *PieceManager) UpdatePeerField(connection int, pieceIndex int32) {
 	//are we now interested in it?
 	//if we are interested add it to missingfield
 
+	if pieceIndex < 0 || int(pieceIndex) >= len(t.availability) {
+		return
+	}
 	//compute the location of this piece in the bitfields
 	index := pieceIndex / 8
 	offset := uint32(pieceIndex % 8)
 	bit := byte(1 << (7 - offset))
 
+	con := t.connection(connection)
+	t.mutex.Lock()
+	if con.peerField[index]&bit == 0 {
+		t.availability[pieceIndex]++
+	}
+	t.mutex.Unlock()
+
 	//add to the peer's list of pieces they have
-	t.manager[connection].peerField[index] |= bit
+	con.peerField[index] |= bit
+
+}
+
+/*
+* takes a disconnected peer's pieces out of the availability counts
+* @connection: the connection descriptor for this peer
+ */
+func (t *PieceManager) RemovePeerField(connection int) {
+	con := t.connection(connection)
+	t.mutex.Lock()
+	for piece := range t.availability {
+		if con.peerField[piece/8]&(1<<(7-uint32(piece%8))) != 0 {
+			t.availability[piece]--
+		}
+	}
+	t.mutex.Unlock()
+	con.peerField = make([]byte, len(con.peerField))
+}
 
+/*
+* chooses the order pieces are requested in, RarestFirst unless set
+* @selection: RarestFirst or Linear
+ */
+func (t *PieceManager) SetPieceSelection(selection PieceSelection) {
+	t.mutex.Lock()
+	t.selection = selection
+	t.mutex.Unlock()
 }
 
 /*
  *determines which pieces we should request from 'peer' using 'connecton'
+ *with RarestFirst the pieces fewest peers have come first, ties broken at random
  @connection: connection descriptor for the peer
  returns: whether client is interested
 */
 func (t *PieceManager) ComputeRequestQueue(connection int) bool {
-	//	fmt.Println(t.manager[connection].requestQueue)
-	if len(t.manager[connection].requestQueue) != 0 {
+	con := t.connection(connection)
+	//	fmt.Println(con.requestQueue)
+	if len(con.requestQueue) != 0 {
 
 		return true
 	}
 	//construct the new request queue for the peer
-	t.manager[connection].requestQueue = make([]int, 0, t.maxQueueSize)
-
-	//we are not interested by default
-
-	interested := false
+	con.requestQueue = make([]int, 0, t.maxQueueSize)
 
 	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-	//for all bytes in the peer field
-	for index, element := range t.manager[connection].peerField {
-		//compute what this peer has that no other peers has and we don't have
+	//every piece this peer has that no other peer is fetching and we don't have
+	var candidates []int
+	numPieces := t.infoDict.NumPieces()
+	for index, element := range con.peerField {
 		mask := (^(t.bitField[index]) & element & ^(t.transitField[index]))
-		//if there is anything found
-		if mask != 0 {
-			//we are interested
-			interested = true
-			nums := [8]uint32{0, 1, 2, 3, 4, 5, 6, 7}
-			//go through the mask and get the index of those pieces
-			for _, num := range nums {
-				bit := byte(1 << (7 - num))
-				if mask&bit != 0 {
-					//if can fit in queue, add them to the queue
-					if len(t.manager[connection].requestQueue) < t.maxQueueSize {
-						//add piece to request queue
-
-						t.manager[connection].requestQueue = append(t.manager[connection].requestQueue, index*8+int(num))
-						//a peer has claimed responsibility for this piece
-						t.transitField[index] |= 1 << (7 - num)
-
-					}
-				}
-				//if we can no longer fit pieces in the queue
-				if len(t.manager[connection].requestQueue) == t.maxQueueSize {
-					t.mutex.Unlock()
-					return interested
-				}
+		if mask == 0 {
+			continue
+		}
+		nums := [8]uint32{0, 1, 2, 3, 4, 5, 6, 7}
+		//go through the mask and get the index of those pieces
+		for _, num := range nums {
+			if piece := index*8 + int(num); mask&(1<<(7-num)) != 0 && piece < numPieces {
+				candidates = append(candidates, piece)
 			}
-
 		}
+	}
 
+	if t.selection == RarestFirst {
+		//shuffle first so pieces with the same availability come out in random order
+		for i := range candidates {
+			j := rand.Intn(i + 1)
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return t.availability[candidates[i]] < t.availability[candidates[j]]
+		})
 	}
-	//	fmt.Printf("CONNECTION %d, QUEUE %v\n", connection, t.manager[connection].requestQueue)
 
-	t.mutex.Unlock()
+	for _, piece := range candidates {
+		//if we can no longer fit pieces in the queue
+		if len(con.requestQueue) == t.maxQueueSize {
+			break
+		}
+		//add piece to request queue
+		con.requestQueue = append(con.requestQueue, piece)
+		//a peer has claimed responsibility for this piece
+		t.transitField[piece/8] |= 1 << (7 - uint32(piece%8))
+	}
+	//	fmt.Printf("CONNECTION %d, QUEUE %v\n", connection, con.requestQueue)
 
-	return interested
+	//interested if there is anything found
+	return len(candidates) != 0
 
 }
 
@@ -256,16 +507,25 @@ func (t *PieceManager) GetBitField() []byte {
 }
 
 /*
-* checks to see if we have the piece requested from us
-* @pieceIndex: index of piece to look for
-* returns: whether we have it
+* reads a block a peer requested from us
+* requests outside the piece, or longer than a block, are refused so a peer cannot make us read out of range
+* @pieceIndex: index of the piece
+* @pieceLength: length of the block
+* @pieceBegin: offset of the block in the piece
+* returns: error if the request is invalid or we do not have the piece, the block
  */
 func (t *PieceManager) GetPiece(pieceIndex int32, pieceLength int32, pieceBegin int32) (error, []byte) {
-	//implement
-	index := pieceIndex / 8
-	offset := uint32(pieceIndex % 8)
-	bit := byte(1 << (7 - offset))
-	if t.bitField[index]&bit == 0 {
+	if pieceIndex < 0 || int(pieceIndex) >= t.infoDict.NumPieces() {
+		return errors.New("GetPiece: piece index out of range"), nil
+	}
+	if pieceBegin < 0 || pieceLength <= 0 || pieceLength > BlockSize ||
+		int64(pieceBegin)+int64(pieceLength) > int64(t.infoDict.PieceSize(int(pieceIndex))) {
+		return errors.New("GetPiece: block does not fit in the piece"), nil
+	}
+	t.mutex.Lock()
+	have := t.havePiece(int(pieceIndex))
+	t.mutex.Unlock()
+	if !have {
 		return errors.New("Piece does not exist"), nil
 	}
 	//we have it, so fetch the piece
@@ -273,75 +533,318 @@ func (t *PieceManager) GetPiece(pieceIndex int32, pieceLength int32, pieceBegin
 	if err != nil {
 		return err, nil
 	}
-
-	if pieceBegin+pieceLength > int32(len(arr)) {
-		return errors.New("PieceLength is bigger than requested piece or part of piece"), nil
-	}
-
-	return err, arr[pieceBegin : pieceBegin+pieceLength]
-
+	return nil, arr[pieceBegin : pieceBegin+pieceLength]
 }
 
 /*
-ReceivedPiece writes a received piece and marks it off and writes it
-* @pieceIndex: piece we got
-* @piece: the actual piece bytes
-* returns: status
+ReceiveBlock stores a received block, once every block of the piece is in, the piece is verified and written
+* @connection: connection descriptor of the peer that sent the block
+* @pieceIndex: piece the block belongs to
+* @begin: offset of the block in the piece
+* @block: the actual block bytes
+* returns: whether the block completed the piece, error if the block is invalid or the piece failed its hash check
 */
-func (t *PieceManager) ReceivePiece(connection int, pieceIndex int32, piece []byte) error {
+func (t *PieceManager) ReceiveBlock(connection int, pieceIndex int32, begin int32, block []byte) (bool, error) {
+	piece := int(pieceIndex)
+	if piece < 0 || piece >= t.infoDict.NumPieces() {
+		return false, errors.New("ReceiveBlock: piece index out of range")
+	}
+	pieceSize := t.infoDict.PieceSize(piece)
+	if begin < 0 || int(begin)%BlockSize != 0 || int(begin) >= pieceSize || len(block) != blockLength(pieceSize, int(begin)) {
+		return false, errors.New("ReceiveBlock: block does not match a block of the piece")
+	}
 
 	index := pieceIndex / 8
 	offset := uint32(pieceIndex % 8)
 	bit := byte(1 << (7 - offset))
-	if t.bitField[index]&bit == 1 {
-		return errors.New("ReceivePiece: received piece we already have")
-	} else {
 
-		err := t.fileWriter.Write(piece, int(pieceIndex))
+	con := t.connection(connection)
+	req := BlockRequest{Piece: piece, Begin: int(begin), Length: len(block)}
+	t.mutex.Lock()
+	//the block is no longer in flight, whether or not we still need it
+	removeBlock(&con.inFlight, req)
+	//in endgame other peers may have it in flight too, they get a cancel
+	for _, other := range t.connections() {
+		if other != con && removeBlock(&other.inFlight, req) {
+			select {
+			case other.cancelQueue <- req:
+			default:
+			}
+		}
+	}
+	if t.bitField[index]&bit != 0 {
+		//a duplicate from endgame or a late block, nothing to do
+		t.mutex.Unlock()
+		return false, nil
+	}
+	buf, ok := t.partial[piece]
+	if !ok {
+		numBlocks := (pieceSize + BlockSize - 1) / BlockSize
+		buf = &pieceBuffer{data: make([]byte, pieceSize), received: make([]bool, numBlocks), from: make([]int, numBlocks), missing: numBlocks}
+		t.partial[piece] = buf
+	}
+	if blockNum := int(begin) / BlockSize; !buf.received[blockNum] {
+		copy(buf.data[begin:], block)
+		buf.received[blockNum] = true
+		buf.from[blockNum] = connection
+		buf.missing--
+		delete(t.endgame, req)
+	}
+	if buf.missing > 0 {
+		t.mutex.Unlock()
+		t.progressChanged(false)
+		return false, nil
+	}
+	//the piece is complete, whatever happens next this buffer is done
+	delete(t.partial, piece)
+	t.mutex.Unlock()
 
-		if err != nil {
+	if con.currentPiece == piece {
+		con.currentPiece = -1
+		con.blockQueue = nil
+	}
 
-			t.mutex.Lock()
-			t.bitField[index] &= ^bit
-			t.mutex.Unlock()
+	if err := t.fileWriter.Write(buf.data, piece); err != nil {
+		//bad data, let the piece be requested again from scratch
+		t.mutex.Lock()
+		t.transitField[index] &= ^bit
+		if t.endgame != nil {
+			t.addEndgameBlocks(piece)
+		}
+		t.mutex.Unlock()
+		return false, err
+	}
 
-			//	fmt.Printf("%v\n", err)
+	t.mutex.Lock()
+	//we now have  the piece
+	t.bitField[index] |= bit
+	t.mutex.Unlock()
+	//only now the bytes count as downloaded, for the torrent and for each peer that sent a block
+	atomic.AddInt64(&t.counts.downloaded, int64(pieceSize))
+	for blockNum, from := range buf.from {
+		if from >= 0 {
+			atomic.AddInt64(&t.connections()[from].counts.downloaded, int64(blockLength(pieceSize, blockNum*BlockSize)))
+		}
+	}
+	t.downloadStatus <- byte(1)
+	t.progressChanged(true)
+	return true, nil
+}
 
-		} else {
-			t.mutex.Lock()
-			//we now have  the piece
-			t.bitField[index] |= bit
+/*
+* gets the next block request for the given connection, the block counts as in flight until it arrives
+* pieces are taken from the request queue one at a time and split into blocks
+* once every missing piece is claimed, falls back to endgame requests
+* @connection: descriptor for the given connection
+* returns: the block, Piece is -1 if there is nothing left to request from this peer
+ */
+func (t *PieceManager) GetNextRequest(connection int) BlockRequest {
+	con := t.connection(connection)
+	for {
+		for len(con.blockQueue) == 0 {
+			con.currentPiece = -1
+			//if queue is empty
+			if len(con.requestQueue) == 0 {
+				//compute a new one if there is more to request
+				if val := t.ComputeRequestQueue(connection); val == false {
+					return t.nextEndgameRequest(connection)
+				}
+			}
+			//pop off queue
+			next := con.requestQueue[0]
+			con.requestQueue = con.requestQueue[1:]
+
+			con.currentPiece = next
+			con.blockQueue = t.missingBlocks(next)
+		}
+
+		next := con.blockQueue[0]
+		con.blockQueue = con.blockQueue[1:]
+		t.mutex.Lock()
+		//an endgame request to another peer may have brought it in already
+		if !t.blockReceived(next) {
+			con.inFlight = append(con.inFlight, next)
 			t.mutex.Unlock()
-			t.downloadStatus <- byte(1)
+			return next
 		}
-		return err
+		t.mutex.Unlock()
+	}
+}
+
+/*
+* checks whether endgame mode has blocks for this peer, without requesting them
+* @connection: descriptor for the given connection
+* returns: whether the connection should stay interested
+ */
+func (t *PieceManager) HasEndgameRequests(connection int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.endgameCandidates(connection)) != 0
+}
+
+/*
+* HELPER
+* picks a random endgame block for the connection and marks it in flight
+ */
+func (t *PieceManager) nextEndgameRequest(connection int) BlockRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	candidates := t.endgameCandidates(connection)
+	if len(candidates) == 0 {
+		return BlockRequest{Piece: -1}
+	}
+	next := candidates[rand.Intn(len(candidates))]
+	con := t.connection(connection)
+	con.inFlight = append(con.inFlight, next)
+	return next
+}
+
+/*
+* HELPER
+* endgame mode starts once every piece we lack is claimed by some connection
+* from then on the missing blocks the peer has may be requested from it too, even if they are in flight elsewhere
+* the missing blocks are collected once when endgame mode starts, and taken out as they arrive
+* mutex must be held
+* returns: blocks the connection may request, empty if we are not in endgame mode
+ */
+func (t *PieceManager) endgameCandidates(connection int) []BlockRequest {
+	if t.endgame == nil {
+		numPieces := t.infoDict.NumPieces()
+		for piece := 0; piece < numPieces; piece++ {
+			if !t.havePiece(piece) && t.transitField[piece/8]&(1<<(7-uint32(piece%8))) == 0 {
+				return nil
+			}
+		}
+		t.endgame = make(map[BlockRequest]bool)
+		for piece := 0; piece < numPieces; piece++ {
+			t.addEndgameBlocks(piece)
+		}
+	}
+
+	con := t.connection(connection)
+	requested := make(map[BlockRequest]int)
+	for _, other := range t.connections() {
+		for _, block := range other.inFlight {
+			requested[block]++
+		}
+	}
+	for _, block := range con.inFlight {
+		//already asked this peer
+		requested[block] = endgameMaxDuplicates
+	}
 
+	var candidates []BlockRequest
+	for block := range t.endgame {
+		if con.peerField[block.Piece/8]&(1<<(7-uint32(block.Piece%8))) != 0 && requested[block] < endgameMaxDuplicates {
+			candidates = append(candidates, block)
+		}
 	}
-	return nil
+	return candidates
+}
 
+/*
+* HELPER
+* adds the blocks of a piece that have not been received yet to the endgame set
+* mutex must be held
+ */
+func (t *PieceManager) addEndgameBlocks(piece int) {
+	if t.havePiece(piece) {
+		return
+	}
+	pieceSize := t.infoDict.PieceSize(piece)
+	for begin := 0; begin < pieceSize; begin += BlockSize {
+		block := BlockRequest{Piece: piece, Begin: begin, Length: blockLength(pieceSize, begin)}
+		if !t.blockReceived(block) {
+			t.endgame[block] = true
+		}
+	}
 }
 
 /*
-* gets the next piece request for the given connection
-* @connection: descriptor for the given connection
-* returns index
+* HELPER
+* lists the blocks of a piece that have not been received yet
  */
-func (t *PieceManager) GetNextRequest(connection int) int {
-	//	fmt.Println(t.manager[connection].requestQueue)
-	//if queue is empty
+func (t *PieceManager) missingBlocks(piece int) []BlockRequest {
+	pieceSize := t.infoDict.PieceSize(piece)
 
-	if len(t.manager[connection].requestQueue) == 0 {
-		//compute a new one if there is more to request
-		if val := t.ComputeRequestQueue(connection); val == false {
-			return -1
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var blocks []BlockRequest
+	for begin := 0; begin < pieceSize; begin += BlockSize {
+		block := BlockRequest{Piece: piece, Begin: begin, Length: blockLength(pieceSize, begin)}
+		if !t.blockReceived(block) {
+			blocks = append(blocks, block)
 		}
 	}
-	//fmt.Println(t.manager[connection].requestQueue)
-	//pop off queue
-	next := t.manager[connection].requestQueue[0]
-	t.manager[connection].requestQueue = t.manager[connection].requestQueue[1:]
+	return blocks
+}
 
-	return next
+/*
+* HELPER
+* whether the block is stored, either in a piece buffer or as part of a verified piece
+* mutex must be held
+ */
+func (t *PieceManager) blockReceived(block BlockRequest) bool {
+	if t.havePiece(block.Piece) {
+		return true
+	}
+	buf := t.partial[block.Piece]
+	return buf != nil && buf.received[block.Begin/BlockSize]
+}
+
+/*
+* HELPER
+* mutex must be held
+ */
+func (t *PieceManager) havePiece(piece int) bool {
+	return t.bitField[piece/8]&(1<<(7-uint32(piece%8))) != 0
+}
+
+/*
+* HELPER
+* snapshot of the registered connections
+ */
+func (t *PieceManager) connections() []*ConnectionPieceManager {
+	t.managerMutex.Lock()
+	defer t.managerMutex.Unlock()
+	return t.manager
+}
+
+/*
+* HELPER
+* the piece manager of a single connection, RegisterConnection may be growing the list meanwhile
+* @connection: connection descriptor
+ */
+func (t *PieceManager) connection(connection int) *ConnectionPieceManager {
+	t.managerMutex.Lock()
+	defer t.managerMutex.Unlock()
+	return t.manager[connection]
+}
+
+/*
+* HELPER
+* removes a block from a list of blocks
+* returns: whether it was in the list
+ */
+func removeBlock(blocks *[]BlockRequest, block BlockRequest) bool {
+	for i, b := range *blocks {
+		if b == block {
+			*blocks = append((*blocks)[:i], (*blocks)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* HELPER
+* length of the block starting at begin, only the last block of a piece is shorter than BlockSize
+ */
+func blockLength(pieceSize int, begin int) int {
+	if pieceSize-begin < BlockSize {
+		return pieceSize - begin
+	}
+	return BlockSize
 }
 
 /*
@@ -366,11 +869,12 @@ func (t *PieceManager) GetNextHaveBroadcast(connection int) chan int32 {
 			}
 		}
 	}*/
-	curLen := len(t.manager[connection].haveBroadcastQueue)
+	con := t.connection(connection)
+	curLen := len(con.haveBroadcastQueue)
 	subChan := make(chan int32, curLen)
 	for i := 0; i < curLen; i++ {
 		select {
-		case have := <-t.manager[connection].haveBroadcastQueue:
+		case have := <-con.haveBroadcastQueue:
 			//fmt.Println("Got have:", connection, "piece:", have)
 			subChan <- have
 		default:
@@ -411,29 +915,243 @@ func (t *PieceManager) CreateHaveBroadcast(connection int, pieceIndex int32) {
 		//unlock*/
 }
 
+/*
+* counts payload bytes sent to a peer
+* @connection: connection descriptor of the peer
+* @n: number of bytes
+ */
+func (t *PieceManager) AddUploaded(connection int, n int) {
+	atomic.AddInt64(&t.counts.uploaded, int64(n))
+	atomic.AddInt64(&t.connection(connection).counts.uploaded, int64(n))
+	//uploads alone are not worth a save, the total goes out with the next one
+}
+
+/*
+* payload exchanged with a single peer, downloaded bytes only count once their piece passed its hash check
+* @connection: connection descriptor of the peer
+* returns: bytes uploaded, bytes downloaded
+ */
+func (t *PieceManager) ConnectionProgress(connection int) (uploaded int64, downloaded int64) {
+	counts := t.connection(connection).counts
+	return atomic.LoadInt64(&counts.uploaded), atomic.LoadInt64(&counts.downloaded)
+}
+
 /**
 * returns the current progress of the uploading/downloading
+* uploaded and downloaded are payload bytes over every session, left is the size of the pieces we still need
 **/
 func (t *PieceManager) GetProgress() (uploaded int, downloaded int, left int) {
-	bitField := t.GetBitField()
-	uploaded = 0 // for now no uploading
-	numDownloaded := 0
-	for _, b := range bitField {
-		if b != 0 {
-			numDownloaded += int(((b >> 7) & 1) + ((b >> 6) & 1) + ((b >> 5) & 1) + ((b >> 4) & 1) + ((b >> 3) & 1) + ((b >> 2) & 1) + ((b >> 1) & 1) + b&1)
+	uploaded = int(atomic.LoadInt64(&t.counts.uploaded))
+	downloaded = int(atomic.LoadInt64(&t.counts.downloaded))
+	t.mutex.Lock()
+	for piece := 0; piece < t.infoDict.NumPieces(); piece++ {
+		if !t.havePiece(piece) {
+			left += t.infoDict.PieceSize(piece)
 		}
 	}
-	downloaded = numDownloaded * t.infoDict.PieceLength
-	left = t.infoDict.Length - downloaded
+	t.mutex.Unlock()
 	return
 }
 
 /**
-* saves bitfield to file
+* saves the resume data: bitfield, blocks of incomplete pieces, totals, known peers and the state of the data files
 **/
 func (t *PieceManager) SaveProgress() error {
-	bitField := t.GetBitField()
-	fmt.Println("Saving progress...")
-	err := t.fileWriter.WriteMetaData(bitField)
-	return err
+	if t.resume == nil {
+		return nil
+	}
+	t.resume.lock.Lock()
+	defer t.resume.lock.Unlock()
+	atomic.StoreInt32(&t.resume.dirty, 0)
+
+	resume := ResumeData{InfoHash: t.resume.infoHash, Peers: t.resume.peers}
+	t.mutex.Lock()
+	resume.BitField = string(t.bitField)
+	for piece, buf := range t.partial {
+		saved := ResumePiece{Index: int64(piece)}
+		for blockNum, ok := range buf.received {
+			if ok {
+				begin := blockNum * BlockSize
+				data := buf.data[begin : begin+blockLength(len(buf.data), begin)]
+				saved.Blocks = append(saved.Blocks, ResumeBlock{Begin: int64(begin), Data: string(data)})
+			}
+		}
+		resume.Partial = append(resume.Partial, saved)
+	}
+	t.mutex.Unlock()
+	resume.Uploaded = atomic.LoadInt64(&t.counts.uploaded)
+	resume.Downloaded = atomic.LoadInt64(&t.counts.downloaded)
+
+	//every piece in the bitfield has to be on disk before the file state is taken
+	if err := t.fileWriter.Sync(); err != nil {
+		return err
+	}
+	stamps, err := t.fileWriter.Stamps()
+	if err != nil {
+		return err
+	}
+	resume.Files = stamps
+	return resume.Save(t.fileWriter.ResumePath)
+}
+
+/*
+* HELPER
+* saves the resume data every resumeInterval while the progress changes,
+* and right away when asked to, at most once per resumeInterval
+ */
+func (t *PieceManager) saveLoop() {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+	var lastImmediate time.Time
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&t.resume.dirty) == 0 {
+				continue
+			}
+		case <-t.resume.saveNow:
+			//pieces completing in a burst are left to the ticker, the progress is still dirty
+			if time.Since(lastImmediate) < resumeInterval {
+				continue
+			}
+			lastImmediate = time.Now()
+		}
+		if err := t.SaveProgress(); err != nil {
+			fmt.Println("Unable to save resume data:", err)
+		}
+	}
+}
+
+/*
+* HELPER
+* marks the resume data as out of date
+* @pieceDone: a piece completed, save right away instead of waiting for the next interval
+ */
+func (t *PieceManager) progressChanged(pieceDone bool) {
+	if t.resume == nil {
+		return
+	}
+	atomic.StoreInt32(&t.resume.dirty, 1)
+	if pieceDone {
+		select {
+		case t.resume.saveNow <- true:
+		default: //a save is already pending
+		}
+	}
+}
+
+/*
+* HELPER
+* reads the resume data of the download
+* missing, corrupt or foreign resume data reads as empty
+* @size: length of the bitfield
+* returns: the resume data
+ */
+func (t *PieceManager) loadResumeData(size int) ResumeData {
+	resume, err := LoadResumeData(t.fileWriter.ResumePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Ignoring resume data:", err)
+		}
+		return ResumeData{}
+	}
+	if resume.InfoHash != t.resume.infoHash || len(resume.BitField) != size {
+		fmt.Println("Ignoring resume data of another torrent")
+		return ResumeData{}
+	}
+	return resume
+}
+
+/*
+* HELPER
+* compares the data files with the sizes and modification times saved in the resume data
+* without resume data the data files are only trusted if we just created them
+* @resume: the resume data
+* returns: whether the bitfield of the resume data can be trusted
+ */
+func (t *PieceManager) dataUnchanged(resume ResumeData) bool {
+	if resume.Version == 0 {
+		return !t.fileWriter.Existed
+	}
+	stamps, err := t.fileWriter.Stamps()
+	if err != nil || len(stamps) != len(resume.Files) {
+		return false
+	}
+	for i, stamp := range stamps {
+		if stamp != resume.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+* HELPER
+* takes over the totals, known peers and blocks of incomplete pieces from the resume data
+* blocks of pieces we have by now, or that do not fit the piece, are dropped
+* @resume: the resume data
+ */
+func (t *PieceManager) restoreResumeData(resume ResumeData) {
+	t.counts.uploaded = resume.Uploaded
+	t.counts.downloaded = resume.Downloaded
+	t.resume.peers = resume.Peers
+
+	for _, saved := range resume.Partial {
+		piece := int(saved.Index)
+		if piece < 0 || piece >= t.infoDict.NumPieces() || t.havePiece(piece) {
+			continue
+		}
+		pieceSize := t.infoDict.PieceSize(piece)
+		numBlocks := (pieceSize + BlockSize - 1) / BlockSize
+		buf := &pieceBuffer{data: make([]byte, pieceSize), received: make([]bool, numBlocks), from: make([]int, numBlocks), missing: numBlocks}
+		for _, block := range saved.Blocks {
+			begin := int(block.Begin)
+			if begin < 0 || begin%BlockSize != 0 || begin >= pieceSize || len(block.Data) != blockLength(pieceSize, begin) || buf.received[begin/BlockSize] {
+				continue
+			}
+			copy(buf.data[begin:], block.Data)
+			buf.received[begin/BlockSize] = true
+			buf.from[begin/BlockSize] = -1
+			buf.missing--
+		}
+		//a piece with every block would never be requested again, it is downloaded from scratch instead
+		if buf.missing > 0 && buf.missing < numBlocks {
+			t.partial[piece] = buf
+		}
+	}
+}
+
+/*
+* remembers a peer we completed a handshake with, it is saved with the resume data
+* @peer: the peer, ignored without an address
+ */
+func (t *PieceManager) AddKnownPeer(peer Peer) {
+	if t.resume == nil || peer.IP == "" {
+		return
+	}
+	t.resume.lock.Lock()
+	defer t.resume.lock.Unlock()
+	var peers []Peer
+	for _, known := range t.resume.peers {
+		if known.Addr() != peer.Addr() {
+			peers = append(peers, known)
+		}
+	}
+	peers = append(peers, peer)
+	if len(peers) > maxResumePeers {
+		peers = peers[len(peers)-maxResumePeers:]
+	}
+	t.resume.peers = peers
+}
+
+/*
+* returns: the peers saved with the resume data, to contact before the tracker answers
+ */
+func (t *PieceManager) KnownPeers() []Peer {
+	if t.resume == nil {
+		return nil
+	}
+	t.resume.lock.Lock()
+	defer t.resume.lock.Unlock()
+	return append([]Peer(nil), t.resume.peers...)
 }
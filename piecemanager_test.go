@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+* HELPER
+* writes data to a file and describes it as a single file torrent
+* @pieceLength: piece length of the torrent
+* returns: the info dictionary, the path of the data
+ */
+func seedTorrent(t *testing.T, data []byte, pieceLength int) (*InfoDict, string) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pieces := ""
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[begin:end])
+		pieces += string(hash[:])
+	}
+	return &InfoDict{Name: "data.bin", Length: len(data), PieceLength: pieceLength, Pieces: pieces}, path
+}
+
+func TestGetPiece(t *testing.T) {
+	data := make([]byte, 2*BlockSize+100) //two pieces, the last one 100 bytes
+	for i := range data {
+		data[i] = byte(i)
+	}
+	iDict, path := seedTorrent(t, data, 2*BlockSize)
+	pm, err := NewSeedPieceManager(iDict, 10, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.fileWriter.Finish()
+
+	tests := []struct {
+		name    string
+		index   int32
+		begin   int32
+		length  int32
+		wantErr bool
+	}{
+		{name: "first block", index: 0, begin: 0, length: BlockSize},
+		{name: "second block", index: 0, begin: BlockSize, length: BlockSize},
+		{name: "short last piece", index: 1, begin: 0, length: 100},
+		{name: "negative index", index: -1, begin: 0, length: BlockSize, wantErr: true},
+		{name: "index past the last piece", index: 2, begin: 0, length: BlockSize, wantErr: true},
+		{name: "huge index", index: 1 << 30, begin: 0, length: BlockSize, wantErr: true},
+		{name: "negative begin", index: 0, begin: -1, length: BlockSize, wantErr: true},
+		{name: "zero length", index: 0, begin: 0, length: 0, wantErr: true},
+		{name: "negative length", index: 0, begin: 0, length: -5, wantErr: true},
+		{name: "longer than a block", index: 0, begin: 0, length: BlockSize + 1, wantErr: true},
+		{name: "past the end of the piece", index: 0, begin: BlockSize + 1, length: BlockSize, wantErr: true},
+		{name: "past the end of the last piece", index: 1, begin: 0, length: 101, wantErr: true},
+		{name: "int32 overflow", index: 0, begin: 1<<31 - 10, length: BlockSize, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err, block := pm.GetPiece(tt.index, tt.length, tt.begin)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("invalid request served")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			offset := int(tt.index)*iDict.PieceLength + int(tt.begin)
+			if !bytes.Equal(block, data[offset:offset+int(tt.length)]) {
+				t.Fatal("wrong block")
+			}
+		})
+	}
+}
+
+func TestNewVerifyPieceManager(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//downloads are laid out relative to the working directory
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	data := make([]byte, 3*BlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	iDict, _ := seedTorrent(t, data, BlockSize)
+	dataPath, resumePath := downloadPaths(iDict, "data.bin")
+	if err := os.Mkdir(filepath.Dir(dataPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	//the second piece is damaged on disk
+	damaged := append([]byte(nil), data...)
+	damaged[BlockSize] ^= 0xff
+	if err := os.WriteFile(dataPath, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm, err := NewVerifyPieceManager(iDict, "hash", 10, "data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pm.havePiece(0) || pm.havePiece(1) || !pm.havePiece(2) {
+		t.Fatalf("bitfield %08b, want 10100000", pm.bitField)
+	}
+	if err := pm.SaveProgress(); err != nil {
+		t.Fatal(err)
+	}
+	pm.fileWriter.Finish()
+	resume, err := LoadResumeData(resumePath)
+	if err != nil || resume.BitField != string(pm.bitField) {
+		t.Fatalf("resume data %v, %v does not hold the checked bitfield", resume.BitField, err)
+	}
+	after, err := os.Stat(dataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		t.Fatal("verify changed the data file")
+	}
+
+	// a download that is not on disk is reported, not created
+	if _, err := NewVerifyPieceManager(iDict, "hash", 10, "gone.bin"); err == nil {
+		t.Fatal("missing data verified")
+	}
+	if _, err := os.Stat("gone"); !os.IsNotExist(err) {
+		t.Fatal("verify created the missing download")
+	}
+}
+
+/*
+* HELPER
+* a piece manager downloading into a zeroed file, it keeps no resume data
+* @path: the file, overwritten
+* returns: the piece manager
+ */
+func downloadingPieceManager(t *testing.T, iDict *InfoDict, path string) *PieceManager {
+	if err := os.WriteFile(path, make([]byte, iDict.TotalLength()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	var pm PieceManager
+	pm.fileWriter = &FileWriter{Info: iDict, DataFiles: []DataFile{{Path: path, Length: int64(iDict.TotalLength()), File: file}}}
+	pm.bitField = make([]byte, (iDict.NumPieces()+7)/8)
+	pm.setup(iDict, 10)
+	return &pm
+}
+
+func TestEndgameCancel(t *testing.T) {
+	data := make([]byte, 4*BlockSize) //two pieces of two blocks
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	iDict, path := seedTorrent(t, data, 2*BlockSize)
+	pm := downloadingPieceManager(t, iDict, path)
+	first := pm.RegisterConnection([]byte{0xc0})
+	second := pm.RegisterConnection([]byte{0xc0})
+	receive := func(connection int, block BlockRequest) (bool, error) {
+		begin := block.Piece*iDict.PieceLength + block.Begin
+		return pm.ReceiveBlock(connection, int32(block.Piece), int32(block.Begin), data[begin:begin+block.Length])
+	}
+
+	var requested []BlockRequest
+	for block := pm.GetNextRequest(first); block.Piece != -1; block = pm.GetNextRequest(first) {
+		requested = append(requested, block)
+	}
+	if len(requested) != 4 {
+		t.Fatalf("first peer got %d requests, want all 4 blocks", len(requested))
+	}
+	// every missing piece is claimed, the second peer gets blocks already in flight
+	if !pm.HasEndgameRequests(second) {
+		t.Fatal("no endgame requests once every piece was claimed")
+	}
+	sent, queued := pm.GetNextRequest(second), pm.GetNextRequest(second)
+	if sent.Piece == -1 || queued.Piece == -1 || sent == queued {
+		t.Fatalf("endgame requests %v and %v, want two different blocks", sent, queued)
+	}
+
+	// the first peer's connection sent one request and still queues the other
+	cm := NewConnectionManager(pm, 10, 10, nil, nil)
+	cm.descriptor = first
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	cm.conn, cm.pWriter = local, bufio.NewWriter(local)
+	if err := cm.QueueMessage(REQUEST, Payload{pieceIndex: int32(queued.Piece), begin: int32(queued.Begin), length: int32(queued.Length)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second peer is faster
+	for _, block := range []BlockRequest{sent, queued} {
+		if _, err := receive(second, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := pm.NumInFlight(first); n != 2 {
+		t.Fatalf("first peer has %d blocks in flight, want the 2 not delivered", n)
+	}
+	wire := make(chan Message, 1)
+	go func() {
+		var p Packet
+		msg, err := p.ReceiveArbitraryPacket(bufio.NewReader(remote), 5, remote)
+		if err != nil {
+			t.Error(err)
+		}
+		wire <- msg
+	}()
+	if err := cm.SendNextMessage(); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-wire
+	if msg.Mtype != CANCEL || int(msg.Payload.pieceIndex) != sent.Piece || int(msg.Payload.begin) != sent.Begin || int(msg.Payload.length) != sent.Length {
+		t.Fatalf("sent %+v, want a CANCEL of %v", msg, sent)
+	}
+	if len(cm.msgQueue) != 0 {
+		t.Fatal("the queued request was not taken back")
+	}
+
+	// a block that crossed the cancel is dropped, the rest completes the download
+	if done, err := receive(first, sent); done || err != nil {
+		t.Fatalf("late duplicate: %v, %v", done, err)
+	}
+	for _, block := range requested {
+		if block != sent && block != queued {
+			if _, err := receive(first, block); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !pm.Complete() || pm.NumInFlight(first) != 0 || pm.NumInFlight(second) != 0 || pm.HasEndgameRequests(second) {
+		t.Fatal("download not complete after every block arrived")
+	}
+}
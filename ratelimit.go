@@ -0,0 +1,172 @@
+package main
+
+/*
+* caps bandwidth with token buckets
+* a transfer takes its bytes from the bucket right away, running it into debt if need be,
+* and waits until the bucket refilled to zero, so large messages are not starved by small ones
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket refilled at an adjustable rate, a nil RateLimiter does not limit
+type RateLimiter struct {
+	rate *int64 //bytes per second, 0 for no limit, shared with the limiters forked from this one
+
+	tokens float64          //bytes that may be sent right away, negative while in debt
+	last   time.Time        //time tokens was last refilled
+	now    func() time.Time //time.Now, tests replace it to control the refill
+
+	lock *sync.Mutex
+}
+
+// RateLimits are the buckets the traffic of a connection goes through, e.g. the session's, the torrent's and its own
+type RateLimits struct {
+	Upload   []*RateLimiter
+	Download []*RateLimiter
+}
+
+// TorrentLimits are the limits of a single torrent in bytes per second, 0 for no limit
+type TorrentLimits struct {
+	Upload   int
+	Download int
+}
+
+/*
+* create a rate limiter
+* @rate: bytes per second, 0 for no limit
+* returns: the limiter
+ */
+func NewRateLimiter(rate int) *RateLimiter {
+	limit := int64(rate)
+	return &RateLimiter{rate: &limit, last: time.Now(), now: time.Now, lock: &sync.Mutex{}}
+}
+
+/*
+* create a limiter with a bucket of its own running at this limiter's rate, SetRate on either changes both
+* used to give every connection the same per peer limit
+* returns: the new limiter, nil if this one is nil
+ */
+func (r *RateLimiter) Fork() *RateLimiter {
+	if r == nil {
+		return nil
+	}
+	return &RateLimiter{rate: r.rate, last: r.now(), now: r.now, lock: &sync.Mutex{}}
+}
+
+/*
+* changes the rate, transfers waiting already keep their wait
+* @rate: bytes per second, 0 for no limit
+ */
+func (r *RateLimiter) SetRate(rate int) {
+	if r == nil {
+		return
+	}
+	atomic.StoreInt64(r.rate, int64(rate))
+}
+
+/*
+* returns: the rate in bytes per second, 0 for no limit
+ */
+func (r *RateLimiter) Rate() int {
+	if r == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(r.rate))
+}
+
+/*
+* HELPER
+* takes n bytes from the bucket
+* @n: number of bytes
+* returns: how long to wait before the bytes may go
+ */
+func (r *RateLimiter) reserve(n int) time.Duration {
+	rate := float64(r.Rate())
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	if rate <= 0 {
+		r.tokens = 0
+		r.last = now
+		return 0
+	}
+	//refill, holding at most a second worth of bytes
+	r.tokens += now.Sub(r.last).Seconds() * rate
+	if r.tokens > rate {
+		r.tokens = rate
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / rate * float64(time.Second))
+}
+
+/*
+* waits until n bytes may be transferred through every limiter
+* @n: number of bytes
+* @limiters: the limiters, nil ones are skipped
+ */
+func WaitRateLimits(n int, limiters []*RateLimiter) {
+	var wait time.Duration
+	for _, r := range limiters {
+		if r == nil {
+			continue
+		}
+		if d := r.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+/*
+* reads a limits file, one "<output file> <upload KiB/s> <download KiB/s>" per line, 0 for no limit, # starts a comment
+* torrents are named by the output file, or data path, they were started with
+* @path: the file
+* returns: the limits of every torrent the file lists, error if a line is malformed
+ */
+func LoadTorrentLimits(path string) (map[string]TorrentLimits, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	limits := make(map[string]TorrentLimits)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("LoadTorrentLimits: line %d: expected <output file> <upload KiB/s> <download KiB/s>", lineNum)
+		}
+		upload, err := strconv.Atoi(fields[1])
+		if err != nil || upload < 0 {
+			return nil, fmt.Errorf("LoadTorrentLimits: line %d: bad upload limit %q", lineNum, fields[1])
+		}
+		download, err := strconv.Atoi(fields[2])
+		if err != nil || download < 0 {
+			return nil, fmt.Errorf("LoadTorrentLimits: line %d: bad download limit %q", lineNum, fields[2])
+		}
+		limits[fields[0]] = TorrentLimits{Upload: upload * 1024, Download: download * 1024}
+	}
+	return limits, scanner.Err()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+* HELPER
+* a limiter whose refill only moves with the returned clock
+* @rate: bytes per second
+* returns: the limiter, the time it sees
+ */
+func fakeClockLimiter(rate int) (*RateLimiter, *time.Time) {
+	clock := time.Unix(1000, 0)
+	r := NewRateLimiter(rate)
+	r.now = func() time.Time { return clock }
+	r.last = clock
+	return r, &clock
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	tests := []struct {
+		name    string
+		advance time.Duration // time passed since the previous step
+		n       int
+		want    time.Duration
+	}{
+		{name: "starts empty", n: 500, want: 500 * time.Millisecond},
+		{name: "debt paid off", advance: 500 * time.Millisecond, n: 0, want: 0},
+		{name: "refilled while idle", advance: 250 * time.Millisecond, n: 250, want: 0},
+		{name: "burst capped at a second", advance: 5 * time.Second, n: 1000, want: 0},
+		{name: "large message runs into debt", n: 1500, want: 1500 * time.Millisecond},
+		{name: "waits behind the debt", advance: time.Second, n: 500, want: time.Second},
+	}
+	r, clock := fakeClockLimiter(1000)
+	for _, tt := range tests {
+		*clock = clock.Add(tt.advance)
+		if got := r.reserve(tt.n); got != tt.want {
+			t.Fatalf("%s: waits %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	r, _ := fakeClockLimiter(1000)
+	fork := r.Fork()
+	if got := r.reserve(1000); got != time.Second {
+		t.Fatalf("waits %v, want 1s", got)
+	}
+	// a fork has a bucket of its own
+	if got := fork.reserve(500); got != 500*time.Millisecond {
+		t.Fatalf("fork waits %v, want 500ms", got)
+	}
+
+	// no limit forgets the debt, for the fork as well
+	r.SetRate(0)
+	if got := r.reserve(1 << 30); got != 0 || fork.Rate() != 0 {
+		t.Fatalf("unlimited waits %v, fork rate %d", got, fork.Rate())
+	}
+	fork.SetRate(2000)
+	if got := r.reserve(1000); got != 500*time.Millisecond {
+		t.Fatalf("waits %v at the fork's new rate, want 500ms", got)
+	}
+
+	var unlimited *RateLimiter
+	unlimited.SetRate(10)
+	if unlimited.Rate() != 0 || unlimited.Fork() != nil {
+		t.Fatal("nil limiter limits")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+/*
+* measures the transfer rate of a connection
+* the rate is a moving average so a single burst or stall does not swing it
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+// rateMeterWindow is roughly how far back the average reaches
+const rateMeterWindow = 5 * time.Second
+
+// RateMeter averages the bytes per second added to it
+type RateMeter struct {
+	rate    float64   //smoothed bytes per second
+	pending int64     //bytes added since the last update
+	last    time.Time //time of the last update
+
+	lock *sync.Mutex
+}
+
+/*
+* create a rate meter
+* returns: the meter, starting at a rate of 0
+ */
+func NewRateMeter() *RateMeter {
+	return &RateMeter{last: time.Now(), lock: &sync.Mutex{}}
+}
+
+/*
+* counts transferred bytes
+* @n: number of bytes
+ */
+func (r *RateMeter) Add(n int) {
+	r.lock.Lock()
+	r.pending += int64(n)
+	r.lock.Unlock()
+}
+
+/*
+* returns: the current rate in bytes per second
+ */
+func (r *RateMeter) Rate() float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	elapsed := time.Since(r.last)
+	if elapsed < time.Second {
+		return r.rate
+	}
+	sample := float64(r.pending) / elapsed.Seconds()
+	weight := float64(elapsed) / float64(rateMeterWindow)
+	if weight > 1 {
+		weight = 1
+	}
+	r.rate += weight * (sample - r.rate)
+	r.pending = 0
+	r.last = time.Now()
+	return r.rate
+}
@@ -0,0 +1,112 @@
+package main
+
+/*
+* resume data, what we need to pick a download up where it stopped
+* saved bencoded to a temp file that is then renamed over the old one, so a crash never leaves a half written file
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// resumeVersion is bumped whenever the layout of ResumeData changes
+const resumeVersion = 1
+
+// resumeInterval is the time between two saves while blocks arrive, about the most work a crash loses
+const resumeInterval = 5 * time.Second
+
+//ResumeBlock is a block of a piece that is not complete yet
+type ResumeBlock struct {
+	Begin int64  `bencode:"begin"`
+	Data  string `bencode:"data"`
+}
+
+//ResumePiece holds the blocks received so far of a piece that is not complete yet
+type ResumePiece struct {
+	Index  int64         `bencode:"index"`
+	Blocks []ResumeBlock `bencode:"blocks"`
+}
+
+//ResumeData is the bencoded content of the resume file
+type ResumeData struct {
+	Version    int64         `bencode:"version"`
+	InfoHash   string        `bencode:"info hash"`
+	BitField   string        `bencode:"bitfield"`
+	Partial    []ResumePiece `bencode:"partial"`
+	Uploaded   int64         `bencode:"uploaded"`
+	Downloaded int64         `bencode:"downloaded"`
+	Peers      []Peer        `bencode:"peers"` //peers we completed a handshake with
+	Files      []FileStamp   `bencode:"files"` //data files as they were when the bitfield was saved
+}
+
+/*
+* reads a resume file
+* @path: the resume file
+* returns: the resume data, error if the file is missing, corrupt or from an unknown version
+ */
+func LoadResumeData(path string) (ResumeData, error) {
+	var r ResumeData
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	if err := bencode.DecodeBytes(data, &r); err != nil {
+		return r, err
+	}
+	if r.Version != resumeVersion {
+		return r, fmt.Errorf("LoadResumeData: unknown version %d", r.Version)
+	}
+	return r, nil
+}
+
+/*
+* writes the resume file, first to a temp file which then replaces the old file
+* @path: the resume file
+* returns: error
+ */
+func (r *ResumeData) Save(path string) error {
+	if path == "" {
+		return errors.New("ResumeData: no resume file")
+	}
+	r.Version = resumeVersion
+	data, err := bencode.EncodeBytes(r)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+/*
+* HELPER
+* writes a file through a temp file that then replaces it, a crash leaves either the old or the new file
+* @path: the file
+* @data: its new content
+* returns: error
+ */
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	//the data has to be on disk before the rename makes it the file
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
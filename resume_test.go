@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".data.bin.resume")
+	saved := ResumeData{
+		InfoHash:   "abcdefghijabcdefghij",
+		BitField:   "\xa0\x01",
+		Partial:    []ResumePiece{{Index: 3, Blocks: []ResumeBlock{{Begin: 0, Data: "block"}, {Begin: BlockSize, Data: "other block"}}}},
+		Uploaded:   1234,
+		Downloaded: 5678,
+		Peers:      []Peer{{IP: "10.0.0.1", Port: 6881}, {IP: "::1", Port: 51413}},
+		Files:      []FileStamp{{Size: 100, ModTime: 42}, {Size: 0, ModTime: 43}},
+	}
+	if err := saved.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file left behind after saving")
+	}
+	loaded, err := LoadResumeData(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Version != resumeVersion || !reflect.DeepEqual(loaded, saved) {
+		t.Fatalf("loaded %+v, saved %+v", loaded, saved)
+	}
+
+	// saving again replaces the file
+	saved.Uploaded = 9999
+	if err := saved.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadResumeData(path); err != nil || loaded.Uploaded != 9999 {
+		t.Fatalf("loaded %d, %v after saving again, want 9999", loaded.Uploaded, err)
+	}
+}
+
+func TestLoadResumeDataRejects(t *testing.T) {
+	otherVersion, err := bencode.EncodeBytes(ResumeData{Version: resumeVersion + 1, InfoHash: "abcdefghijabcdefghij"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noVersion, err := bencode.EncodeBytes(struct {
+		InfoHash string `bencode:"info hash"`
+	}{"abcdefghijabcdefghij"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "not bencode", data: []byte("not resume data")},
+		{name: "cut short", data: otherVersion[:len(otherVersion)/2]},
+		{name: "empty", data: nil},
+		{name: "unknown version", data: otherVersion},
+		{name: "no version", data: noVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".data.bin.resume")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadResumeData(path); err == nil {
+				t.Fatal("bad resume data loaded")
+			}
+		})
+	}
+}
+
+func TestResumeDataInterruptedSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".data.bin.resume")
+	old := ResumeData{InfoHash: "abcdefghijabcdefghij", Uploaded: 1}
+	if err := old.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	// a crash while saving leaves a half written temp file, the resume file is untouched
+	if err := os.WriteFile(path+".tmp", []byte("d7:version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadResumeData(path); err != nil || loaded.Uploaded != 1 {
+		t.Fatalf("loaded %d, %v next to a half written save, want 1", loaded.Uploaded, err)
+	}
+
+	// the next save goes through the same temp file
+	next := ResumeData{InfoHash: "abcdefghijabcdefghij", Uploaded: 2}
+	if err := next.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadResumeData(path); err != nil || loaded.Uploaded != 2 {
+		t.Fatalf("loaded %d, %v, want 2", loaded.Uploaded, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp file left behind after saving")
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+/*
+* runs several torrents at once
+* every torrent has its own pieces, peers and tracker loop, they share the port peers connect to
+* incoming connections are handed to the torrent whose info hash the peer sends in its handshake
+ */
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// routeTimeout is how long an incoming peer has to send its handshake
+const routeTimeout = 30 * time.Second
+
+// stopAnnounceTimeout is how long Stop waits for the trackers to take the stopped announce
+const stopAnnounceTimeout = 10 * time.Second
+
+// dhtAnnounceInterval is the time between two DHT lookups of a torrent
+const dhtAnnounceInterval = 10 * time.Minute
+
+// Session owns the torrents we download and seed, and the port peers connect to
+type Session struct {
+	port        int
+	policy      *PeerPolicy //which peers we connect to and accept, nil admits everyone
+	maxUnchoked uint32      //peers unchoked at once per torrent
+	maxRequests int         //most block requests in flight to a single peer
+	selection   PieceSelection
+	encryption  EncryptionMode //MSE for the connections of every torrent, in and out
+
+	upload       *RateLimiter //limits of all torrents together
+	download     *RateLimiter
+	peerUpload   *RateLimiter //limits of every single connection
+	peerDownload *RateLimiter
+
+	dht *DHT //finds peers without a tracker, nil until StartDHT
+	lsd *LSD //finds peers on the local network, nil until StartLSD
+
+	listener net.Listener //set while Listen runs
+
+	torrents map[string]*SessionTorrent //by info hash
+	lock     *sync.Mutex
+}
+
+// SessionTorrent is a torrent run by a session
+type SessionTorrent struct {
+	Name string
+
+	session      *Session
+	infoDict     *InfoDict
+	infoHash     string
+	pieceManager PieceManager
+	manager      PeerContactManager
+	tracker      TrackerInfo
+	trackerDone  chan bool // closed once the stopped announce went out, or nothing was ever announced
+	upload       *RateLimiter
+	download     *RateLimiter
+	stopped      chan bool //closed by Stop
+	wg           sync.WaitGroup
+	stopOnce     *sync.Once
+}
+
+/*
+* create a session, Listen accepts incoming peers
+* @port: port peers connect to, announced to the trackers of every torrent
+* @policy: peer admission rules, nil admits everyone
+* @maxUnchoked: peers unchoked at once per torrent
+* @maxRequests: most block requests in flight to a single peer
+* @selection: order pieces are requested in
+* returns: the session
+ */
+func NewSession(port int, policy *PeerPolicy, maxUnchoked uint32, maxRequests int, selection PieceSelection) *Session {
+	return &Session{
+		port:         port,
+		policy:       policy,
+		maxUnchoked:  maxUnchoked,
+		maxRequests:  maxRequests,
+		selection:    selection,
+		encryption:   EncryptionEnabled,
+		upload:       NewRateLimiter(0),
+		download:     NewRateLimiter(0),
+		peerUpload:   NewRateLimiter(0),
+		peerDownload: NewRateLimiter(0),
+		torrents:     make(map[string]*SessionTorrent),
+		lock:         &sync.Mutex{},
+	}
+}
+
+/*
+* starts downloading a torrent, or seeding it
+* the tracker is contacted in the background, the torrent takes incoming peers right away
+* @torrent: the torrent
+* @fileName: output file of a download, the data on disk when seeding
+* @seed: serve data that is already on disk instead of downloading
+* returns: the running torrent, error if the data cannot be seeded or the torrent is already running
+ */
+func (s *Session) AddTorrent(torrent *Torrent, fileName string, seed bool) (*SessionTorrent, error) {
+	hash := torrent.InfoHash()
+	iDict := torrent.InfoDict()
+	t := &SessionTorrent{
+		Name:        iDict.Name,
+		session:     s,
+		infoDict:    &iDict,
+		infoHash:    string(hash),
+		stopOnce:    &sync.Once{},
+		stopped:     make(chan bool),
+		trackerDone: make(chan bool),
+		upload:      NewRateLimiter(0),
+		download:    NewRateLimiter(0),
+	}
+
+	s.lock.Lock()
+	_, running := s.torrents[t.infoHash]
+	s.lock.Unlock()
+	if running {
+		return nil, fmt.Errorf("AddTorrent: %s is already running", t.Name)
+	}
+
+	var err error
+	if seed {
+		fmt.Println("Checking", fileName)
+		if t.pieceManager, err = NewSeedPieceManager(&iDict, 10, fileName); err != nil {
+			return nil, err
+		}
+	} else {
+		t.pieceManager = NewPieceManager(&iDict, t.infoHash, 10, fileName, false)
+	}
+
+	t.tracker = NewTracker(hash, torrent, &iDict, ClientID, s.port)
+	t.tracker.Uploaded, t.tracker.Downloaded, t.tracker.Left = t.pieceManager.GetProgress()
+
+	tInfo := TorrentInfo{
+		TInfo:        &iDict,
+		ClientID:     ClientID,
+		ProtoName:    ProtoName,
+		ProtoNameLen: len(ProtoName),
+		InfoHash:     t.infoHash,
+		Extensions:   NewExtensionRegistry(),
+	}
+	if !iDict.IsPrivate() {
+		//peers of private torrents come from their trackers alone, no DHT lookups and no PORT messages
+		tInfo.DHT = s.dht
+	}
+	tInfo.Extensions.Register(NewMetadataExtension(torrent.Info))
+	t.manager = NewPeerContactManager(&t.tracker, &t.wg, tInfo, t.pieceManager, 10, s.maxUnchoked, 10, s.maxRequests, s.policy)
+	//peers our peers know about join the pool, registered after the manager that takes them
+	var pex *PexExtension
+	if !iDict.IsPrivate() {
+		pex = NewPexExtension(s.port, t.manager.AddPeers)
+		tInfo.Extensions.Register(pex)
+	}
+	t.manager.SetPieceSelection(s.selection)
+	s.lock.Lock()
+	t.manager.SetEncryption(s.encryption)
+	s.lock.Unlock()
+	t.manager.SetRateLimits(RateLimits{
+		Upload:   []*RateLimiter{s.upload, t.upload},
+		Download: []*RateLimiter{s.download, t.download},
+	}, s.peerUpload, s.peerDownload)
+
+	s.lock.Lock()
+	if _, running := s.torrents[t.infoHash]; running {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("AddTorrent: %s is already running", t.Name)
+	}
+	s.torrents[t.infoHash] = t
+	s.lock.Unlock()
+
+	go t.run()
+	if pex != nil {
+		go t.pexUpdater(pex)
+	}
+	if s.lsd != nil && !iDict.IsPrivate() {
+		s.lsd.Add(t.infoHash, t.manager.AddPeers)
+	}
+	if tInfo.DHT != nil {
+		go t.dhtAnnouncer(tInfo.DHT)
+	}
+	return t, nil
+}
+
+/*
+* starts a DHT node, torrents added from now on also get their peers from it
+* @port: UDP port of the node
+* @cachePath: file the known nodes are kept in between runs
+* returns: error if the node cannot be started
+ */
+func (s *Session) StartDHT(port int, cachePath string) error {
+	dht, err := NewDHT(port, cachePath)
+	if err != nil {
+		return err
+	}
+	s.dht = dht
+	go dht.Bootstrap()
+	return nil
+}
+
+/*
+* starts local service discovery, torrents added from now on are announced on the local network
+* returns: error if the multicast group cannot be joined
+ */
+func (s *Session) StartLSD() error {
+	lsd, err := NewLSD(s.port)
+	if err != nil {
+		return err
+	}
+	s.lsd = lsd
+	return nil
+}
+
+/*
+* returns: the session's DHT node, nil if it does not run one
+ */
+func (s *Session) DHT() *DHT {
+	return s.dht
+}
+
+/*
+* listens on the session's port and hands incoming peers to their torrent
+* returns: error, when the listener fails, nil once Close stopped it
+ */
+func (s *Session) Listen() error {
+	// listen on all network interfaces on the session's port
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(s.port))
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	s.lock.Lock()
+	s.listener = ln
+	s.lock.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.listener == nil
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !s.policy.AdmitAddress(addr.IP) {
+			conn.Close()
+			continue
+		}
+		go s.route(conn)
+	}
+}
+
+/*
+* HELPER
+* reads the handshake of an incoming peer and hands the connection to the torrent it asks for
+* @conn: the incoming connection
+ */
+func (s *Session) route(conn net.Conn) {
+	fmt.Println(conn.LocalAddr().String(), " Got connection from ", conn.RemoteAddr().String())
+	s.lock.Lock()
+	infoHashes := make([]string, 0, len(s.torrents))
+	for hash := range s.torrents {
+		infoHashes = append(infoHashes, hash)
+	}
+	mode := s.encryption
+	s.lock.Unlock()
+	//an encrypted peer names its torrent inside the key exchange
+	peerConn, err := AcceptEncryption(conn, infoHashes, mode)
+	if err != nil {
+		fmt.Printf("%v: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn = peerConn
+
+	conn.SetReadDeadline(time.Now().Add(routeTimeout))
+	hs, err := ReadHandshake(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	s.lock.Lock()
+	t, ok := s.torrents[hs.InfoHash]
+	s.lock.Unlock()
+	if !ok {
+		fmt.Printf("%v asked for a torrent we do not have\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	t.manager.Accept(conn, hs)
+}
+
+/*
+* chooses whether connections are encrypted, applies to torrents added from now on and to incoming peers
+* @mode: EncryptionDisabled, EncryptionEnabled or EncryptionForced
+ */
+func (s *Session) SetEncryption(mode EncryptionMode) {
+	s.lock.Lock()
+	s.encryption = mode
+	s.lock.Unlock()
+}
+
+/*
+* caps the bandwidth of all torrents together, takes effect right away
+* @upload: bytes per second, 0 for no limit
+* @download: bytes per second, 0 for no limit
+ */
+func (s *Session) SetRateLimits(upload int, download int) {
+	s.upload.SetRate(upload)
+	s.download.SetRate(download)
+}
+
+/*
+* caps the bandwidth of every single connection, takes effect right away
+* @upload: bytes per second, 0 for no limit
+* @download: bytes per second, 0 for no limit
+ */
+func (s *Session) SetPeerRateLimits(upload int, download int) {
+	s.peerUpload.SetRate(upload)
+	s.peerDownload.SetRate(download)
+}
+
+/*
+* stops taking peers and every torrent, saving their progress and the DHT's known nodes
+ */
+func (s *Session) Close() {
+	s.lock.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+		s.listener = nil
+	}
+	var torrents []*SessionTorrent
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.lock.Unlock()
+
+	for _, t := range torrents {
+		t.Stop()
+	}
+	if s.dht != nil {
+		if err := s.dht.Close(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+}
+
+/*
+* HELPER
+* connects to the peers of the last run, then contacts the tracker, keeps announcing and connects to the peers it hands out
+* torrents without trackers only get peers from the last run, the DHT, LSD and PEX
+ */
+func (t *SessionTorrent) run() {
+	// peers from the last run need no tracker, dial them while the first announce is out
+	t.manager.AddPeers(t.pieceManager.KnownPeers())
+
+	if len(t.tracker.tiers) == 0 {
+		fmt.Println("No trackers for", t.Name, "finding peers without them")
+		close(t.trackerDone)
+	} else {
+		peerList, interval, err := t.connectTracker()
+		if err != nil {
+			close(t.trackerDone)
+			return
+		}
+		// keep announcing to tracker at the interval it asks for
+		go t.trackerUpdater(t.tracker, interval)
+		t.manager.AddPeers(peerList)
+	}
+
+	if err := t.manager.StartOutgoing(nil); err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+* HELPER
+* looks the torrent up in the DHT every dhtAnnounceInterval, announcing our port and connecting to the peers found
+* @dht: the session's DHT node
+ */
+func (t *SessionTorrent) dhtAnnouncer(dht *DHT) {
+	for {
+		peers := dht.GetPeers(t.infoHash, t.session.port)
+		fmt.Printf("DHT found %d peers for %s\n", len(peers), t.Name)
+		t.manager.AddPeers(peers)
+		select {
+		case <-t.stopped:
+			return
+		case <-time.After(dhtAnnounceInterval):
+		}
+	}
+}
+
+/*
+* HELPER
+* sends our peers the peers we connected to and dropped every pexInterval
+* @pex: the torrent's ut_pex extension
+ */
+func (t *SessionTorrent) pexUpdater(pex *PexExtension) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopped:
+			return
+		case <-ticker.C:
+			pex.Update(t.manager.Connections())
+		}
+	}
+}
+
+/*
+* keeps serving peers once the download is complete
+* @ratio: stop once we uploaded ratio times the torrent's size, 0 for no limit
+* @limit: stop after seeding this long, 0 for no limit
+ */
+func (t *SessionTorrent) Seed(ratio float64, limit time.Duration) {
+	t.manager.Seed(ratio, limit)
+}
+
+/*
+* caps the bandwidth of the torrent, takes effect right away
+* @upload: bytes per second, 0 for no limit
+* @download: bytes per second, 0 for no limit
+ */
+func (t *SessionTorrent) SetRateLimits(upload int, download int) {
+	t.upload.SetRate(upload)
+	t.download.SetRate(download)
+}
+
+/*
+* stops the torrent: saves its progress, sends the stopped announce and stops taking incoming peers
+* stopping twice does nothing
+ */
+func (t *SessionTorrent) Stop() {
+	t.stopOnce.Do(func() {
+		t.session.lock.Lock()
+		delete(t.session.torrents, t.infoHash)
+		t.session.lock.Unlock()
+		close(t.stopped)
+		if t.session.lsd != nil {
+			t.session.lsd.Remove(t.infoHash)
+		}
+
+		fmt.Println("Stopping", t.Name)
+		if err := t.manager.StopDownload(); err != nil {
+			fmt.Println(err)
+		}
+		//a tracker that does not answer the stopped announce does not hold up the shutdown
+		select {
+		case <-t.trackerDone:
+		case <-time.After(stopAnnounceTimeout):
+			fmt.Println("Tracker did not take the stopped announce of", t.Name)
+		}
+	})
+}
+
+/*
+* HELPER
+* sends the started announce, retrying with backoff until a tracker answers
+* returns: the tracker's peers and announce interval, error if the torrent was stopped first
+ */
+func (t *SessionTorrent) connectTracker() ([]Peer, time.Duration, error) {
+	type connectResult struct {
+		peers    []Peer
+		interval time.Duration
+		err      error
+	}
+	for failures := 1; ; failures++ {
+		//the announce runs on its own so Stop does not wait for a slow tracker
+		result := make(chan connectResult, 1)
+		go func() {
+			peerList, interval, err := t.tracker.Connect()
+			result <- connectResult{peerList, interval, err}
+		}()
+
+		var r connectResult
+		select {
+		case r = <-result:
+		case <-t.stopped:
+			go func() {
+				// the tracker may still take the started announce, take it back
+				if r := <-result; r.err == nil {
+					t.tracker.Disconnect()
+				}
+			}()
+			return nil, 0, errors.New("connectTracker: torrent stopped")
+		}
+		if r.err == nil {
+			return r.peers, r.interval, nil
+		}
+
+		wait := trackerBackoff(failures)
+		fmt.Printf("Unable to contact tracker, retrying in %v: %v\n", wait, r.err)
+		select {
+		case <-time.After(wait):
+		case <-t.stopped:
+			// no tracker ever heard of us, there is nothing to announce
+			return nil, 0, errors.New("connectTracker: torrent stopped")
+		}
+	}
+}
+
+/*
+* HELPER
+* announces at the interval the tracker asks for, backing off while it fails,
+* until the torrent is stopped, then sends the stopped announce
+* completion is announced from here as well, so it always follows the started announce
+* @tkInfo: the tracker
+* @interval: time until the first announce
+ */
+func (t *SessionTorrent) trackerUpdater(tkInfo TrackerInfo, interval time.Duration) {
+	defer close(t.trackerDone)
+	fmt.Println("updating...")
+	failures := 0
+	wait := interval
+	completed := t.manager.Downloaded()
+	if tkInfo.Left == 0 {
+		// seeding from the start, there is no download to announce
+		completed = nil
+	}
+	event := ""
+	for {
+		select {
+		case <-t.stopped:
+			tkInfo.Uploaded, tkInfo.Downloaded, tkInfo.Left = t.manager.GetProgress()
+			if err := tkInfo.Disconnect(); err != nil {
+				fmt.Println(err)
+			}
+			return
+		case <-completed:
+			// announce it right away, it is sent again with the next announce if this one fails
+			completed = nil
+			event = "completed"
+		case <-time.After(wait):
+		}
+		tkInfo.Uploaded, tkInfo.Downloaded, tkInfo.Left =
+			t.manager.GetProgress()
+		peerList, next, err := tkInfo.Update(event)
+		if err != nil {
+			failures++
+			wait = trackerBackoff(failures)
+			fmt.Printf("Tracker announce failed, retrying in %v: %v\n", wait, err)
+			continue
+		}
+		failures = 0
+		wait = next
+		event = ""
+		// connect to any peers the tracker handed out since the last announce
+		t.manager.AddPeers(peerList)
+	}
+}
@@ -21,18 +21,21 @@ type Torrent struct {
 }
 
 // InfoDict is the info dictionary
+// Single file torrents set Length, multi-file torrents set Files instead
+// Private torrents (BEP 27) only get their peers from their trackers
 type InfoDict struct {
-	Name        string `bencode:"name"`
-	Length      int    `bencode:"length"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
+	Name        string     `bencode:"name"`
+	Length      int        `bencode:"length,omitempty"`
+	Files       []InfoFile `bencode:"files,omitempty"`
+	PieceLength int        `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Private     int        `bencode:"private,omitempty"`
 }
 
-//InfoFile is currently unused
+//InfoFile is an entry in the files list of a multi-file torrent
 type InfoFile struct {
-	Name   string   `bencode:"name"`
 	Length int      `bencode:"length"`
-	Md5Sum string   `bencode:"md5sum"`
+	Md5Sum string   `bencode:"md5sum,omitempty"`
 	Path   []string `bencode:"path"`
 }
 
@@ -72,6 +75,42 @@ func (t *Torrent) InfoDict() (id InfoDict) {
 	if err := bencode.DecodeBytes(t.Info, &id); err != nil {
 		log.Fatal("Unable to parse the Info Dictionary in the torrent file", err)
 	}
+	// every piece offset and size is computed from the piece length
+	if id.PieceLength <= 0 {
+		log.Fatal("Invalid piece length in the Info Dictionary: ", id.PieceLength)
+	}
 
 	return id
 }
+
+//TotalLength returns the number of bytes in the torrent across all of its files
+func (id *InfoDict) TotalLength() int {
+	if len(id.Files) == 0 {
+		return id.Length
+	}
+	total := 0
+	for _, f := range id.Files {
+		total += f.Length
+	}
+	return total
+}
+
+//IsPrivate reports whether peers may only come from the torrent's trackers, not the DHT, PEX or LSD
+func (id *InfoDict) IsPrivate() bool {
+	return id.Private == 1
+}
+
+//NumPieces returns the number of pieces the torrent is split into
+func (id *InfoDict) NumPieces() int {
+	return len(id.Pieces) / 20
+}
+
+//PieceSize returns the length of the piece at index, only the last piece can be shorter
+func (id *InfoDict) PieceSize(index int) int {
+	if index == id.NumPieces()-1 {
+		if rem := id.TotalLength() % id.PieceLength; rem != 0 {
+			return rem
+		}
+	}
+	return id.PieceLength
+}
@@ -1,33 +1,134 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/zeebo/bencode"
 )
 
 //TrackerInfo contains the infomation needed to connect and disconnect from tracker
 type TrackerInfo struct {
-	urlStub    string // this is the part that is always constant
+	tiers      []*trackerTier // announce-list tiers, a single tier for a plain announce URL
 	Uploaded   int
 	Downloaded int
 	Left       int
+
+	NumWant int    // number of peers to ask for
+	IP      string // address to tell the tracker to hand out, empty to let it use the source address
+	key     uint32 // random per session, lets trackers recognise us if our IP changes
+
+	// AnnounceToAllTiers announces to every tier at once instead of
+	// only moving to the next tier when all trackers in a tier failed
+	AnnounceToAllTiers bool
+}
+
+//announcer is a tracker transport, there is one for each announce URL scheme
+type announcer interface {
+	announce(req announceRequest) (TrackerResponse, error)
+	scrape() (ScrapeResult, error)
+	close()
+	url() string
+}
+
+//trackerTier is one tier of the announce-list (BEP 12)
+//trackers are tried in order and the one that responds is moved to the front
+type trackerTier struct {
+	announcers []announcer
+	lock       *sync.Mutex
+}
+
+//announceRequest holds the parameters that change between announces
+type announceRequest struct {
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      string // "started", "completed", "stopped" or "" for a regular update
+	NumWant    int
+	Key        uint32
+	IP         string
 }
 
+// defaultAnnounceInterval is used when a tracker does not send an interval, in seconds
+const defaultAnnounceInterval = 1800
+
+// httpTrackerClient gives up on a tracker that accepts the connection but never answers
+var httpTrackerClient = &http.Client{Timeout: 30 * time.Second}
+
 //TrackerResponse is the decoded response of the Tracker
 type TrackerResponse struct {
-	Complete    int64  `bencode:"complete"`
-	Downloaded  int64  `bencode:"downloaded"`
-	Incomplete  int64  `bencode:"incomplete"`
-	Interval    int64  `bencode:"interval"`
-	MinInterval int64  `bencode:"min interval"`
-	Peers       []Peer `bencode:"peers"`
+	FailureReason  string    `bencode:"failure reason"`  // set when the tracker refused the announce
+	WarningMessage string    `bencode:"warning message"` // announce succeeded but the tracker has a complaint
+	TrackerID      string    `bencode:"tracker id"`      // to be sent back on later announces
+	Complete       int64     `bencode:"complete"`
+	Downloaded     int64     `bencode:"downloaded"`
+	Incomplete     int64     `bencode:"incomplete"`
+	Interval       int64     `bencode:"interval"`
+	MinInterval    int64     `bencode:"min interval"`
+	Peers          PeerList  `bencode:"peers"`
+	Peers6         PeerList6 `bencode:"peers6"`
+}
+
+//TrackerError is returned when an announce or scrape to a tracker does not succeed
+type TrackerError struct {
+	URL    string // the tracker's announce URL
+	Reason string // failure reason sent by the tracker, empty when it could not be reached
+	Err    error  // underlying network or decoding error, nil when the tracker sent a failure reason
+}
+
+func (e *TrackerError) Error() string {
+	if e.Reason != "" {
+		return "tracker " + e.URL + " refused: " + e.Reason
+	}
+	return "tracker " + e.URL + ": " + e.Err.Error()
+}
+
+func (e *TrackerError) Unwrap() error {
+	return e.Err
+}
+
+// backoff limits for re-announcing after tracker errors
+const (
+	minTrackerBackoff = 15 * time.Second
+	maxTrackerBackoff = 30 * time.Minute
+)
+
+//trackerBackoff is how long to wait before retrying after the given number of consecutive failures
+func trackerBackoff(failures int) time.Duration {
+	wait := minTrackerBackoff
+	for i := 1; i < failures && wait < maxTrackerBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxTrackerBackoff {
+		wait = maxTrackerBackoff
+	}
+	return wait
+}
+
+//PeerList is the peers key of a tracker response, sent either as a list of
+//dictionaries or as a compact string of 6 byte entries (BEP 23)
+type PeerList []Peer
+
+//PeerList6 is the peers6 key of a tracker response, a compact string of 18 byte entries (BEP 7)
+type PeerList6 []Peer
+
+//ScrapeResult is the tracker's statistics for a single torrent
+type ScrapeResult struct {
+	Complete   int64 `bencode:"complete"`
+	Downloaded int64 `bencode:"downloaded"`
+	Incomplete int64 `bencode:"incomplete"`
 }
 
 // Peer is the struct containing the ip, peerid and the port of a peer
@@ -37,8 +138,120 @@ type Peer struct {
 	Port   int64  `bencode:"port"`
 }
 
+//Addr is the host:port to dial the peer on, IPv6 addresses are bracketed
+func (p Peer) Addr() string {
+	return net.JoinHostPort(p.IP, strconv.FormatInt(p.Port, 10))
+}
+
+//UnmarshalBencode decodes either form of the peers key
+func (pl *PeerList) UnmarshalBencode(data []byte) error {
+	if len(data) > 0 && data[0] == 'l' {
+		var peers []Peer
+		if err := bencode.DecodeBytes(data, &peers); err != nil {
+			return err
+		}
+		*pl = peers
+		return nil
+	}
+
+	var compact string
+	if err := bencode.DecodeBytes(data, &compact); err != nil {
+		return err
+	}
+	*pl = parseCompactPeers([]byte(compact), net.IPv4len)
+	return nil
+}
+
+//UnmarshalBencode decodes the compact peers6 string
+func (pl *PeerList6) UnmarshalBencode(data []byte) error {
+	var compact string
+	if err := bencode.DecodeBytes(data, &compact); err != nil {
+		return err
+	}
+	*pl = parseCompactPeers([]byte(compact), net.IPv6len)
+	return nil
+}
+
+//nextAnnounce is how long to wait before the next regular announce
+//the tracker's interval is used, but never less than its min interval
+func (r TrackerResponse) nextAnnounce() time.Duration {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	if r.MinInterval > interval {
+		interval = r.MinInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+//AllPeers returns the IPv4 and IPv6 peers of the response together
+func (r TrackerResponse) AllPeers() []Peer {
+	peers := make([]Peer, 0, len(r.Peers)+len(r.Peers6))
+	peers = append(peers, r.Peers...)
+	return append(peers, r.Peers6...)
+}
+
+//httpTracker announces with GET requests to an http:// or https:// URL
+type httpTracker struct {
+	announceURL string
+	urlHash     string // info hash, already escaped for the query string
+	urlStub     string // this is the part that is always constant
+	trackerID   string // tracker id from the last response, if the tracker sent one
+}
+
 //NewTracker initializes a new tracker CONNECTION and takes a byte array of the info hash
-func NewTracker(hash []byte, tInfo *Torrent, iDict *InfoDict, port int) (trkInfo TrackerInfo) {
+//the announce-list is used when present, otherwise the announce URL makes up a single tier
+//peerID is sent in every announce and should match the one in our handshakes
+func NewTracker(hash []byte, tInfo *Torrent, iDict *InfoDict, peerID string, port int) (trkInfo TrackerInfo) {
+	tierURLs := tInfo.AnnounceList
+	if len(tierURLs) == 0 && tInfo.Announce != "" {
+		tierURLs = [][]string{{tInfo.Announce}}
+	}
+
+	for _, urls := range tierURLs {
+		tier := &trackerTier{lock: &sync.Mutex{}}
+		for _, announceURL := range urls {
+			a, err := newAnnouncer(announceURL, hash, peerID, port)
+			if err != nil {
+				fmt.Printf("Skipping tracker %s: %v\n", announceURL, err)
+				continue
+			}
+			tier.announcers = append(tier.announcers, a)
+		}
+		if len(tier.announcers) == 0 {
+			continue
+		}
+		// BEP 12: trackers within a tier are tried in random order
+		rand.Shuffle(len(tier.announcers), func(i, j int) {
+			tier.announcers[i], tier.announcers[j] = tier.announcers[j], tier.announcers[i]
+		})
+		trkInfo.tiers = append(trkInfo.tiers, tier)
+	}
+
+	trkInfo.AnnounceToAllTiers = true
+	trkInfo.NumWant = 50
+	trkInfo.key = rand.Uint32()
+	trkInfo.Uploaded, trkInfo.Downloaded, trkInfo.Left = 0, 0, iDict.TotalLength()
+	return
+}
+
+/*
+* HELPER
+* picks the transport from the scheme of the announce URL
+* returns: the transport, error
+ */
+func newAnnouncer(announceURL string, hash []byte, peerID string, port int) (announcer, error) {
+	switch {
+	case strings.HasPrefix(announceURL, "udp://"):
+		return newUDPTracker(announceURL, hash, peerID, port)
+	case strings.HasPrefix(announceURL, "http://"), strings.HasPrefix(announceURL, "https://"):
+		return newHTTPTracker(announceURL, hash, peerID, port), nil
+	}
+	return nil, errors.New("unsupported tracker URL scheme")
+}
+
+func newHTTPTracker(announce string, hash []byte, peerID string, port int) *httpTracker {
 	hexStr := []rune(hex.EncodeToString(hash))
 	urlHash := ""
 
@@ -46,56 +259,279 @@ func NewTracker(hash []byte, tInfo *Torrent, iDict *InfoDict, port int) (trkInfo
 		urlHash += "%" + string(hexStr[i]) + string(hexStr[i+1])
 	}
 
-	trkInfo.urlStub = tInfo.Announce + "?info_hash=" + urlHash + "&peer_id=DONDESTALABIBLIOTECA&port=" + strconv.Itoa(port)
-	trkInfo.Uploaded, trkInfo.Downloaded, trkInfo.Left = 0, 0, iDict.Length
-	return
+	// private trackers put a passkey in the query of the announce URL, ours goes after it
+	separator := "?"
+	if strings.Contains(announce, "?") {
+		separator = "&"
+	}
+	return &httpTracker{
+		announceURL: announce,
+		urlHash:     urlHash,
+		urlStub:     announce + separator + "info_hash=" + urlHash + "&peer_id=" + neturl.QueryEscape(peerID) + "&port=" + strconv.Itoa(port) + "&compact=1",
+	}
 }
 
-func (trkInfo TrackerInfo) sendGetRequest(event string) []byte {
-	url := trkInfo.urlStub + "&uploaded=" + strconv.Itoa(trkInfo.Uploaded) + "&downloaded=" +
-		strconv.Itoa(trkInfo.Downloaded) + "&left=" + strconv.Itoa(trkInfo.Left)
+func (trk *httpTracker) sendGetRequest(req announceRequest) ([]byte, error) {
+	url := trk.urlStub + "&uploaded=" + strconv.Itoa(req.Uploaded) + "&downloaded=" +
+		strconv.Itoa(req.Downloaded) + "&left=" + strconv.Itoa(req.Left)
 
-	if event != "" { // add event if it s a sepcial event like started or completed
-		url += "&event=" + event
+	if req.Event != "" { // add event if it s a sepcial event like started or completed
+		url += "&event=" + req.Event
+	}
+	url += "&numwant=" + strconv.Itoa(req.NumWant) + fmt.Sprintf("&key=%08x", req.Key)
+	if req.IP != "" {
+		url += "&ip=" + neturl.QueryEscape(req.IP)
+	}
+	if trk.trackerID != "" {
+		url += "&trackerid=" + neturl.QueryEscape(trk.trackerID)
 	}
 
 	fmt.Printf("\nSending GET Request to : %s\n", url)
-	resp, err := http.Get(url)
-	defer resp.Body.Close()
+	resp, err := httpTrackerClient.Get(url)
 	if err != nil {
-		log.Fatal("Unable to contact Tracker", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	fmt.Printf("\nResponse received from Tracker with status code: %d\n", resp.StatusCode)
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal("Internal error reading the response from tracker", err)
+		return nil, err
 	}
-
-	return body
+	// trackers usually send failures as a bencoded failure reason with status 200,
+	// any other status is only an error if the body does not explain it
+	if resp.StatusCode != http.StatusOK && !bytes.Contains(body, []byte("failure reason")) {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return body, nil
 }
 
-//Connect sends a GET request to the tracker
-func (trkInfo TrackerInfo) Connect() ([]Peer, int64) {
-	body := trkInfo.sendGetRequest("started")
+func (trk *httpTracker) announce(req announceRequest) (TrackerResponse, error) {
 	var dec TrackerResponse
-	errDecode := bencode.DecodeBytes(body, &dec)
-	if errDecode != nil {
-		log.Fatal("Unable to decode the Tracker Respose\n", errDecode)
+	body, err := trk.sendGetRequest(req)
+	if err != nil {
+		return dec, &TrackerError{URL: trk.announceURL, Err: err}
+	}
+	if err := bencode.DecodeBytes(body, &dec); err != nil {
+		return dec, &TrackerError{URL: trk.announceURL, Err: err}
+	}
+	if dec.FailureReason != "" {
+		return dec, &TrackerError{URL: trk.announceURL, Reason: dec.FailureReason}
+	}
+	if dec.WarningMessage != "" {
+		fmt.Printf("Tracker %s warning: %s\n", trk.announceURL, dec.WarningMessage)
+	}
+	if dec.TrackerID != "" {
+		trk.trackerID = dec.TrackerID
+	}
+	return dec, nil
+}
+
+func (trk *httpTracker) close() {}
+
+func (trk *httpTracker) url() string {
+	return trk.announceURL
+}
+
+//scrape uses the scrape convention, replacing the last "announce" in the URL path with "scrape"
+func (trk *httpTracker) scrape() (ScrapeResult, error) {
+	var result ScrapeResult
+	slash := strings.LastIndex(trk.announceURL, "/")
+	if slash < 0 || !strings.HasPrefix(trk.announceURL[slash+1:], "announce") {
+		return result, &TrackerError{URL: trk.announceURL, Err: errors.New("tracker does not support scrape")}
+	}
+	url := trk.announceURL[:slash+1] + "scrape" + trk.announceURL[slash+1+len("announce"):]
+	if strings.Contains(url, "?") {
+		url += "&info_hash=" + trk.urlHash
+	} else {
+		url += "?info_hash=" + trk.urlHash
+	}
+
+	resp, err := httpTrackerClient.Get(url)
+	if err != nil {
+		return result, &TrackerError{URL: trk.announceURL, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, &TrackerError{URL: trk.announceURL, Err: err}
+	}
+
+	var dec struct {
+		FailureReason string                  `bencode:"failure reason"`
+		Files         map[string]ScrapeResult `bencode:"files"`
 	}
+	if err := bencode.DecodeBytes(body, &dec); err != nil {
+		return result, &TrackerError{URL: trk.announceURL, Err: err}
+	}
+	if dec.FailureReason != "" {
+		return result, &TrackerError{URL: trk.announceURL, Reason: dec.FailureReason}
+	}
+	for _, r := range dec.Files { // we only asked about one torrent
+		return r, nil
+	}
+	return result, &TrackerError{URL: trk.announceURL, Err: errors.New("scrape response has no entry for the torrent")}
+}
 
-	var peerList []Peer
-	for _, p := range dec.Peers {
-		if strings.HasPrefix(p.PeerID, "-RU11") {
-			peerList = append(peerList, p)
+/*
+* announces to the trackers of one tier, starting with the last one that responded
+* @req: the announce parameters
+* returns: the first successful response, error if every tracker in the tier failed
+ */
+func (tier *trackerTier) announce(req announceRequest) (TrackerResponse, error) {
+	tier.lock.Lock()
+	defer tier.lock.Unlock()
+
+	var lastErr error
+	for i, a := range tier.announcers {
+		resp, err := a.announce(req)
+		if err != nil {
+			fmt.Printf("Tracker %s failed: %v\n", a.url(), err)
+			lastErr = err
+			continue
+		}
+		// promote the tracker that answered to the front of its tier
+		copy(tier.announcers[1:i+1], tier.announcers[:i])
+		tier.announcers[0] = a
+		return resp, nil
+	}
+	return TrackerResponse{}, lastErr
+}
+
+/*
+* announces to the tiers, either all at once or one tier after another until one responds
+* peers from every tier that answered are merged into one response
+* @event: the announce event
+* returns: the merged response, error if no tracker responded
+ */
+func (trkInfo TrackerInfo) announce(event string) (TrackerResponse, error) {
+	req := announceRequest{
+		Uploaded:   trkInfo.Uploaded,
+		Downloaded: trkInfo.Downloaded,
+		Left:       trkInfo.Left,
+		Event:      event,
+		NumWant:    trkInfo.NumWant,
+		Key:        trkInfo.key,
+		IP:         trkInfo.IP,
+	}
+	if len(trkInfo.tiers) == 0 {
+		return TrackerResponse{}, errors.New("announce: torrent has no usable trackers")
+	}
+
+	if !trkInfo.AnnounceToAllTiers {
+		var lastErr error
+		for _, tier := range trkInfo.tiers {
+			resp, err := tier.announce(req)
+			if err == nil {
+				return resp, nil
+			}
+			lastErr = err
 		}
+		return TrackerResponse{}, lastErr
 	}
 
-	return peerList, dec.Interval
+	responses := make([]TrackerResponse, len(trkInfo.tiers))
+	errs := make([]error, len(trkInfo.tiers))
+	var wg sync.WaitGroup
+	for i, tier := range trkInfo.tiers {
+		wg.Add(1)
+		go func(i int, tier *trackerTier) {
+			defer wg.Done()
+			responses[i], errs[i] = tier.announce(req)
+		}(i, tier)
+	}
+	wg.Wait()
+
+	var merged TrackerResponse
+	var lastErr error
+	answered := false
+	seen := make(map[string]bool)
+	for i, resp := range responses {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
+		}
+		if !answered {
+			merged = resp
+			merged.Peers, merged.Peers6 = nil, nil
+			answered = true
+		}
+		for _, p := range resp.Peers {
+			if !seen[p.Addr()] {
+				seen[p.Addr()] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+		for _, p := range resp.Peers6 {
+			if !seen[p.Addr()] {
+				seen[p.Addr()] = true
+				merged.Peers6 = append(merged.Peers6, p)
+			}
+		}
+	}
+	if !answered {
+		return merged, lastErr
+	}
+	return merged, nil
+}
+
+//Connect sends the started announce to the tracker
+//returns: the peers, how long to wait until the next announce, error
+func (trkInfo TrackerInfo) Connect() ([]Peer, time.Duration, error) {
+	return trkInfo.Update("started")
+}
+
+//Update announces to the tracker
+//returns: the peers, how long to wait until the next announce, error
+func (trkInfo TrackerInfo) Update(event string) ([]Peer, time.Duration, error) {
+	dec, err := trkInfo.announce(event)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dec.AllPeers(), dec.nextAnnounce(), nil
 }
 
 // Disconnect sends a event stopped status to the tracker
-func (trkInfo TrackerInfo) Disconnect() {
-	trkInfo.sendGetRequest("stopped")
+func (trkInfo TrackerInfo) Disconnect() error {
+	_, err := trkInfo.announce("stopped")
+	for _, tier := range trkInfo.tiers {
+		tier.lock.Lock()
+		for _, a := range tier.announcers {
+			a.close()
+		}
+		tier.lock.Unlock()
+	}
+	return err
+}
+
+// Scrape asks the preferred tracker of the first tier for the number of seeders, leechers and completed downloads
+func (trkInfo TrackerInfo) Scrape() (ScrapeResult, error) {
+	if len(trkInfo.tiers) == 0 {
+		return ScrapeResult{}, errors.New("Scrape: torrent has no usable trackers")
+	}
+	tier := trkInfo.tiers[0]
+	tier.lock.Lock()
+	a := tier.announcers[0]
+	tier.lock.Unlock()
+	return a.scrape()
+}
+
+/*
+* HELPER
+* decodes peers packed as an IP address followed by a 2 byte port
+* @data: the packed peers
+* @ipLen: 4 for IPv4 entries, 16 for IPv6 entries
+* returns: the peers, without peer ids
+ */
+func parseCompactPeers(data []byte, ipLen int) []Peer {
+	entryLen := ipLen + 2
+	peers := make([]Peer, 0, len(data)/entryLen)
+	for i := 0; i+entryLen <= len(data); i += entryLen {
+		ip := net.IP(append([]byte(nil), data[i:i+ipLen]...))
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+entryLen])
+		peers = append(peers, Peer{IP: ip.String(), Port: int64(port)})
+	}
+	return peers
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPTrackerAnnounceURL(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		announce   string
+		wantPrefix string
+	}{
+		{name: "plain announce URL", announce: server.URL + "/announce", wantPrefix: "info_hash="},
+		{name: "passkey in the query", announce: server.URL + "/announce?passkey=abc", wantPrefix: "passkey=abc&info_hash="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trk := newHTTPTracker(tt.announce, make([]byte, 20), NewPeerID(), 6881)
+			if _, err := trk.announce(announceRequest{Event: "started", Left: 10}); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(query, tt.wantPrefix) || strings.Contains(query, "?") {
+				t.Fatalf("tracker got query %q, want it to start with %q", query, tt.wantPrefix)
+			}
+			if !strings.Contains(query, "&event=started") || !strings.Contains(query, "&left=10") {
+				t.Fatalf("announce parameters missing from %q", query)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+/*
+* UDP tracker protocol (BEP 15)
+* every exchange is a request datagram answered by one response datagram,
+* a connect exchange first obtains a connection id that later announces and scrapes must carry
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// udpProtocolID is the magic constant sent with every connect request
+const udpProtocolID int64 = 0x41727101980
+
+// actions of the UDP tracker protocol
+const (
+	udpActionConnect  int32 = 0
+	udpActionAnnounce int32 = 1
+	udpActionScrape   int32 = 2
+	udpActionError    int32 = 3
+)
+
+// udpConnectionIDLifetime is how long a connection id may be reused for
+const udpConnectionIDLifetime = time.Minute
+
+// udpMaxRetries is how often a request is resent, with 15s, 30s and 60s timeouts a dead tracker costs under two minutes
+// so its tier moves on to the next URL
+const udpMaxRetries = 2
+
+// udpTracker talks to a single udp:// announce URL
+type udpTracker struct {
+	host     string //host:port of the tracker
+	infoHash []byte
+	peerID   string
+	port     int
+
+	timeout    time.Duration //first retransmission timeout, doubled after every attempt
+	maxRetries int           //retransmissions before giving up, connect and the request share them
+
+	conn         net.Conn
+	connectionID int64
+	connectedAt  time.Time
+
+	lock *sync.Mutex //one exchange at a time, they share the socket
+}
+
+/*
+* create a UDP tracker transport
+* @announce: the udp:// announce URL
+* @hash: info hash of the torrent
+* @peerID: our peer id
+* @port: port we listen on for peers
+* returns: the transport, error
+ */
+func newUDPTracker(announce string, hash []byte, peerID string, port int) (*udpTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || u.Port() == "" {
+		return nil, errors.New("newUDPTracker: announce URL needs a host and port")
+	}
+	return &udpTracker{
+		host:       u.Host,
+		infoHash:   hash,
+		peerID:     peerID,
+		port:       port,
+		timeout:    15 * time.Second,
+		maxRetries: udpMaxRetries,
+		lock:       &sync.Mutex{},
+	}, nil
+}
+
+/*
+* announces to the tracker, connecting first if the connection id is missing or stale
+* @req: the announce parameters
+* returns: the decoded response, error
+ */
+func (t *udpTracker) announce(req announceRequest) (TrackerResponse, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var events = map[string]int32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+	var resp TrackerResponse
+	reply, err := t.exchange(udpActionAnnounce, func(buf *bytes.Buffer) {
+		buf.Write(t.infoHash)
+		buf.WriteString(t.peerID)
+		binary.Write(buf, binary.BigEndian, int64(req.Downloaded))
+		binary.Write(buf, binary.BigEndian, int64(req.Left))
+		binary.Write(buf, binary.BigEndian, int64(req.Uploaded))
+		binary.Write(buf, binary.BigEndian, events[req.Event])
+		// ip 0 lets the tracker use the source address, only IPv4 addresses fit
+		var ip [4]byte
+		if parsed := net.ParseIP(req.IP).To4(); parsed != nil {
+			copy(ip[:], parsed)
+		}
+		buf.Write(ip[:])
+		binary.Write(buf, binary.BigEndian, req.Key)
+		numWant := int32(req.NumWant)
+		if numWant <= 0 {
+			numWant = -1 // tracker default
+		}
+		binary.Write(buf, binary.BigEndian, numWant)
+		binary.Write(buf, binary.BigEndian, uint16(t.port))
+	})
+	if err != nil {
+		return resp, t.trackerError(err)
+	}
+	if len(reply) < 12 {
+		return resp, t.trackerError(errors.New("announce response too short"))
+	}
+
+	resp.Interval = int64(binary.BigEndian.Uint32(reply[0:4]))
+	resp.Incomplete = int64(binary.BigEndian.Uint32(reply[4:8]))
+	resp.Complete = int64(binary.BigEndian.Uint32(reply[8:12]))
+	// a tracker reached over IPv6 answers with 18 byte IPv6 entries instead of 6 byte IPv4 ones
+	if addr, ok := t.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		resp.Peers6 = parseCompactPeers(reply[12:], net.IPv6len)
+	} else {
+		resp.Peers = parseCompactPeers(reply[12:], net.IPv4len)
+	}
+	return resp, nil
+}
+
+/*
+* scrapes the tracker for our torrent
+* returns: swarm statistics, error
+ */
+func (t *udpTracker) scrape() (ScrapeResult, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var result ScrapeResult
+	reply, err := t.exchange(udpActionScrape, func(buf *bytes.Buffer) {
+		buf.Write(t.infoHash)
+	})
+	if err != nil {
+		return result, t.trackerError(err)
+	}
+	if len(reply) < 12 {
+		return result, t.trackerError(errors.New("scrape response too short"))
+	}
+	result.Complete = int64(binary.BigEndian.Uint32(reply[0:4]))
+	result.Downloaded = int64(binary.BigEndian.Uint32(reply[4:8]))
+	result.Incomplete = int64(binary.BigEndian.Uint32(reply[8:12]))
+	return result, nil
+}
+
+/*
+* HELPER
+* runs one request/response exchange, connecting first when needed
+* a connection id that expires mid exchange is refreshed and the request resent
+* @action: the request action
+* @body: writes the request fields that follow the header
+* returns: the response after its action and transaction id, error
+ */
+func (t *udpTracker) exchange(action int32, body func(*bytes.Buffer)) ([]byte, error) {
+	if t.conn == nil {
+		conn, err := net.Dial("udp", t.host)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+
+	for attempt := 0; attempt <= t.maxRetries; attempt++ {
+		if t.connectionID == 0 || time.Since(t.connectedAt) > udpConnectionIDLifetime {
+			var err error
+			if attempt, err = t.connect(attempt); err != nil {
+				return nil, err
+			}
+		}
+
+		transactionID := rand.Int31()
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, t.connectionID)
+		binary.Write(buf, binary.BigEndian, action)
+		binary.Write(buf, binary.BigEndian, transactionID)
+		body(buf)
+
+		reply, err := t.roundTrip(buf.Bytes(), action, transactionID, attempt)
+		if err == nil {
+			return reply, nil
+		}
+		if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+			return nil, err
+		}
+		// lost or ignored, the connection id may have expired on the tracker's side
+		t.connectionID = 0
+	}
+	return nil, errors.New("udpTracker: tracker did not respond")
+}
+
+/*
+* HELPER
+* obtains a fresh connection id
+* @attempt: retransmission count to continue from
+* returns: the retransmission count the connect ended on, error
+ */
+func (t *udpTracker) connect(attempt int) (int, error) {
+	for ; attempt <= t.maxRetries; attempt++ {
+		transactionID := rand.Int31()
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, udpProtocolID)
+		binary.Write(buf, binary.BigEndian, udpActionConnect)
+		binary.Write(buf, binary.BigEndian, transactionID)
+
+		reply, err := t.roundTrip(buf.Bytes(), udpActionConnect, transactionID, attempt)
+		if err != nil {
+			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+				continue
+			}
+			return attempt, err
+		}
+		if len(reply) < 8 {
+			return attempt, errors.New("udpTracker: connect response too short")
+		}
+		t.connectionID = int64(binary.BigEndian.Uint64(reply[0:8]))
+		t.connectedAt = time.Now()
+		return attempt, nil
+	}
+	return attempt, errors.New("udpTracker: tracker did not respond to connect")
+}
+
+/*
+* HELPER
+* sends a request and waits 15 * 2^attempt seconds for the matching response
+* datagrams with another transaction id are stale replies and are skipped
+* returns: the response after its action and transaction id, error
+ */
+func (t *udpTracker) roundTrip(request []byte, action int32, transactionID int32, attempt int) ([]byte, error) {
+	if _, err := t.conn.Write(request); err != nil {
+		return nil, err
+	}
+	t.conn.SetReadDeadline(time.Now().Add(t.timeout << uint(attempt)))
+
+	reply := make([]byte, 2048)
+	for {
+		n, err := t.conn.Read(reply)
+		if err != nil {
+			return nil, err
+		}
+		if n < 8 || int32(binary.BigEndian.Uint32(reply[4:8])) != transactionID {
+			continue
+		}
+		switch gotAction := int32(binary.BigEndian.Uint32(reply[0:4])); gotAction {
+		case action:
+			return reply[8:n], nil
+		case udpActionError:
+			return nil, udpFailure(reply[8:n])
+		default:
+			return nil, errors.New("udpTracker: response has the wrong action")
+		}
+	}
+}
+
+// udpFailure is the message of an error action, returned by roundTrip as a failure reason
+type udpFailure []byte
+
+func (f udpFailure) Error() string {
+	return string(f)
+}
+
+/*
+* HELPER
+* wraps an exchange error, error actions become the tracker's failure reason
+ */
+func (t *udpTracker) trackerError(err error) error {
+	if reason, ok := err.(udpFailure); ok {
+		return &TrackerError{URL: t.url(), Reason: string(reason)}
+	}
+	return &TrackerError{URL: t.url(), Err: err}
+}
+
+func (t *udpTracker) url() string {
+	return "udp://" + t.host
+}
+
+/*
+* closes the socket, the next exchange opens a new one
+ */
+func (t *udpTracker) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	t.connectionID = 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestUDPTrackerExchange(t *testing.T) {
+	tests := []struct {
+		name         string
+		drop         int
+		stale        int
+		connectionID int64         // connection id the transport starts with, 0 for none
+		age          time.Duration // how long ago that connection id was obtained
+		wantErr      string        // failure reason, "" for success and "timeout" for no answer
+		wantRequests int
+		wantConnects int
+	}{
+		{name: "announce", wantRequests: 2, wantConnects: 1},
+		{name: "dropped packets", drop: 2, wantRequests: 4, wantConnects: 1},
+		{name: "dead tracker", drop: 100, wantErr: "timeout", wantRequests: udpMaxRetries + 1},
+		{name: "stale transaction id", stale: 2, wantRequests: 2, wantConnects: 1},
+		{name: "expired connection id", connectionID: 42, age: 2 * udpConnectionIDLifetime, wantRequests: 2, wantConnects: 1},
+		{name: "unknown connection id", connectionID: 42, age: time.Second, wantErr: "unknown connection id", wantRequests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lt, err := NewLocalUDPTracker()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lt.Close()
+			// serve reads these as soon as the tracker is up
+			lt.lock.Lock()
+			lt.DropPackets = tt.drop
+			lt.StaleReplies = tt.stale
+			lt.lock.Unlock()
+
+			hash := bytes.Repeat([]byte{1}, 20)
+			u, err := newUDPTracker(lt.URL(), hash, "-MM0001-abcdefghijkl", 6881)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.timeout = 50 * time.Millisecond
+			u.connectionID = tt.connectionID
+			u.connectedAt = time.Now().Add(-tt.age)
+			defer u.close()
+
+			reply, err := u.exchange(udpActionAnnounce, func(buf *bytes.Buffer) {
+				buf.Write(hash)
+				buf.WriteString(u.peerID)
+				buf.Write(make([]byte, 8+8+8+4+4+4)) // downloaded, left, uploaded, event, ip, key
+				binary.Write(buf, binary.BigEndian, int32(-1))
+				binary.Write(buf, binary.BigEndian, uint16(u.port))
+			})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr == "" && len(reply) < 12:
+				t.Fatalf("short announce response: %d bytes", len(reply))
+			case tt.wantErr == "timeout" && err == nil:
+				t.Fatal("dead tracker answered")
+			case tt.wantErr != "" && tt.wantErr != "timeout":
+				if reason, ok := err.(udpFailure); !ok || string(reason) != tt.wantErr {
+					t.Fatalf("got %v, want %q", err, tt.wantErr)
+				}
+			}
+
+			lt.lock.Lock()
+			defer lt.lock.Unlock()
+			if lt.Requests != tt.wantRequests || lt.Connects != tt.wantConnects {
+				t.Fatalf("got %d requests and %d connects, want %d and %d", lt.Requests, lt.Connects, tt.wantRequests, tt.wantConnects)
+			}
+		})
+	}
+}